@@ -0,0 +1,149 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"math"
+	"sync"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+const (
+	MultiModeUniform = iota
+	MultiModeEM
+)
+
+const (
+	emMaxIteration = 1000
+	emTolerance    = 0.01
+)
+
+// emHit is a feature overlapped by one alignment of a multi-mapping read (Fraction from overlap mode)
+type emHit struct {
+	ID       uint32
+	Fraction float32
+}
+
+// emRead is a multi-mapping read with its multiplicity (NH) and all features overlapped by its alignments
+type emRead struct {
+	Multi int
+	Hits  []emHit
+}
+
+// MultiEM redistributes multi-mapping reads between features by expectation-maximization. In a first pass (Collect), features overlapped by multi-mapping reads are recorded per read name, together with the counts of unique reads. Estimate then computes feature abundances. In the second pass, Weight returns the weight of each read alignment on feature.
+type MultiEM struct {
+	Collect   bool
+	mutex     sync.Mutex
+	unique    []float64
+	reads     map[string]*emRead
+	densities []float64
+	scales    map[string]float64
+}
+
+func NewMultiEM(nFeature int) *MultiEM {
+	return &MultiEM{Collect: true, unique: make([]float64, nFeature), reads: make(map[string]*emRead)}
+}
+
+// Add records that one alignment of read name (with multiplicity multi) overlaps feature featID.
+func (em *MultiEM) Add(name string, multi int, featID uint32, fraction float32) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	if multi == 1 {
+		em.unique[featID] += float64(fraction)
+		return
+	}
+	r, ok := em.reads[name]
+	if !ok {
+		r = &emRead{Multi: multi}
+		em.reads[name] = r
+	}
+	r.Hits = append(r.Hits, emHit{ID: featID, Fraction: fraction})
+}
+
+// Estimate computes the abundance of features (starting from uniform weights 1/NH) until convergence. Each multi-mapping read keeps its total weight (as with uniform weights), redistributed between its alignments proportionally to the abundance per nucleotide of the features. It returns the number of iterations.
+func (em *MultiEM) Estimate(features []feature.Feature) int {
+	// Feature lengths
+	lengths := make([]float64, len(features))
+	for i, feat := range features {
+		lengths[i] = math.Max(1., float64(feature.IntervalsLength(feat.Coords)))
+	}
+	// Initial abundances from uniform weights
+	abundances := make([]float64, len(features))
+	copy(abundances, em.unique)
+	for _, r := range em.reads {
+		for _, h := range r.Hits {
+			abundances[h.ID] += float64(h.Fraction) / float64(r.Multi)
+		}
+	}
+	em.densities = make([]float64, len(features))
+	newAbundances := make([]float64, len(features))
+	var iteration int
+	for iteration = 1; iteration <= emMaxIteration; iteration++ {
+		for i := range abundances {
+			em.densities[i] = abundances[i] / lengths[i]
+		}
+		// Expectation and maximization
+		copy(newAbundances, em.unique)
+		for _, r := range em.reads {
+			scale := r.scale(em.densities)
+			for _, h := range r.Hits {
+				if scale == 0. {
+					newAbundances[h.ID] += float64(h.Fraction) / float64(r.Multi)
+				} else {
+					newAbundances[h.ID] += float64(h.Fraction) * em.densities[h.ID] * scale
+				}
+			}
+		}
+		// Convergence
+		var diff float64
+		for i := range abundances {
+			diff = math.Max(diff, math.Abs(newAbundances[i]-abundances[i]))
+		}
+		abundances, newAbundances = newAbundances, abundances
+		if diff < emTolerance {
+			break
+		}
+	}
+	// Final weights
+	for i := range abundances {
+		em.densities[i] = abundances[i] / lengths[i]
+	}
+	em.scales = make(map[string]float64, len(em.reads))
+	for name, r := range em.reads {
+		em.scales[name] = r.scale(em.densities)
+	}
+	em.reads = nil
+	em.Collect = false
+	return iteration
+}
+
+// scale returns the factor converting the density of features into the weight of the read alignments, or 0 if no feature overlapped by the read has reads.
+func (r *emRead) scale(densities []float64) float64 {
+	// Total weight of read with uniform weights
+	var total, sum float64
+	for _, h := range r.Hits {
+		total += float64(h.Fraction)
+		sum += float64(h.Fraction) * densities[h.ID]
+	}
+	if sum == 0. {
+		return 0.
+	}
+	return (total / float64(r.Multi)) / sum
+}
+
+// Weight returns the weight of one alignment of read name (with multiplicity multi) on feature featID. Unique reads and reads not seen during Collect keep their uniform weight.
+func (em *MultiEM) Weight(name string, multi int, featID uint32, fraction float32) float64 {
+	if multi > 1 {
+		if scale, ok := em.scales[name]; ok && scale > 0. {
+			return float64(fraction) * em.densities[featID] * scale
+		}
+	}
+	return float64(fraction) / float64(multi)
+}
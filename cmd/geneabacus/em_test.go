@@ -0,0 +1,69 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+func TestMultiEMEstimate(t *testing.T) {
+	// Features A and B of 100 nt, and C of 400 nt
+	features := []feature.Feature{
+		{ID: 0, Name: "A", Coords: [][]int{{0, 100}}},
+		{ID: 1, Name: "B", Coords: [][]int{{1000, 1100}}},
+		{ID: 2, Name: "C", Coords: [][]int{{2000, 2400}}},
+	}
+	tests := []struct {
+		name    string
+		uniques []int
+		multis  int
+		hits    []uint32
+		want    []float64
+	}{
+		{"unique on A", []int{10, 0, 0}, 4, []uint32{0, 1}, []float64{1, 0}},
+		{"no unique", []int{0, 0, 0}, 4, []uint32{0, 1}, []float64{0.5, 0.5}},
+		{"same unique", []int{5, 5, 0}, 4, []uint32{0, 1}, []float64{0.5, 0.5}},
+		// Fixed point: w = 4(5+4w) / (4(5+4w) + 5+4(1-w)), i.e. 12w² + 13w - 20 = 0
+		{"length", []int{0, 5, 5}, 4, []uint32{1, 2}, []float64{0.8584, 0.1416}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			em := NewMultiEM(len(features))
+			for featID, n := range tt.uniques {
+				for i := 0; i < n; i++ {
+					em.Add("u"+strconv.Itoa(featID)+"_"+strconv.Itoa(i), 1, uint32(featID), 1.)
+				}
+			}
+			for i := 0; i < tt.multis; i++ {
+				for _, featID := range tt.hits {
+					em.Add("m"+strconv.Itoa(i), len(tt.hits), featID, 1.)
+				}
+			}
+			if n := em.Estimate(features); n > emMaxIteration {
+				t.Errorf("got no convergence after %d iterations", emMaxIteration)
+			}
+			for i, featID := range tt.hits {
+				if got := em.Weight("m0", len(tt.hits), featID, 1.); math.Abs(got-tt.want[i]) > emTolerance {
+					t.Errorf("feature %d: got weight %v, want %v", featID, got, tt.want[i])
+				}
+			}
+			// Unique reads and reads missing from Collect keep uniform weights
+			if got := em.Weight("u", 1, 0, 1.); got != 1. {
+				t.Errorf("unique: got weight %v, want 1", got)
+			}
+			if got := em.Weight("missing", 2, 0, 1.); got != 0.5 {
+				t.Errorf("missing: got weight %v, want 0.5", got)
+			}
+		})
+	}
+}
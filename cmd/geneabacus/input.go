@@ -0,0 +1,123 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLz4  = []byte{0x04, 0x22, 0x4d, 0x18}
+	magicXz   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// SAMInput is an opened SAM/BAM file, read directly, decompressed in-process or through a command
+type SAMInput struct {
+	io.Reader
+	f          *os.File
+	cmd        *exec.Cmd
+	pipe       io.ReadCloser
+	closeFuncs []func() error
+	closed     bool
+}
+
+// OpenSAMInput opens the file at path. If cmd is empty, gzip, Zstandard, LZ4 and xz compressed files are detected by their magic bytes and decompressed. Otherwise, cmd is executed with path as last argument and its output is read.
+func OpenSAMInput(path string, cmd []string) (*SAMInput, error) {
+	var err error
+	in := SAMInput{}
+	if len(cmd) > 0 {
+		args := append(append([]string{}, cmd[1:]...), path)
+		in.cmd = exec.Command(cmd[0], args...)
+		in.cmd.Stderr = os.Stderr
+		if in.pipe, err = in.cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+		if err = in.cmd.Start(); err != nil {
+			return nil, err
+		}
+		in.Reader = in.pipe
+		return &in, nil
+	}
+	if in.f, err = os.Open(path); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(in.f)
+	// Errors are reported when reading
+	magic, _ := br.Peek(len(magicXz))
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			in.f.Close()
+			return nil, err
+		}
+		in.Reader = zr
+		in.closeFuncs = append(in.closeFuncs, zr.Close)
+	case bytes.HasPrefix(magic, magicZstd):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			in.f.Close()
+			return nil, err
+		}
+		in.Reader = zr
+		in.closeFuncs = append(in.closeFuncs, func() error { zr.Close(); return nil })
+	case bytes.HasPrefix(magic, magicLz4):
+		in.Reader = lz4.NewReader(br)
+	case bytes.HasPrefix(magic, magicXz):
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			in.f.Close()
+			return nil, err
+		}
+		in.Reader = zr
+	default:
+		in.Reader = br
+	}
+	return &in, nil
+}
+
+// Close closes the file and decompressor, or waits for the command to exit. It returns an error if the command failed. Only the first call has an effect.
+func (in *SAMInput) Close() error {
+	if in.closed {
+		return nil
+	}
+	in.closed = true
+	var err error
+	for _, fn := range in.closeFuncs {
+		if e := fn(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if in.f != nil {
+		if e := in.f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if in.cmd != nil {
+		// Stop command if output is not read until the end
+		in.pipe.Close()
+		if e := in.cmd.Wait(); e != nil && err == nil {
+			err = fmt.Errorf("Command \"%s\" failed: %w", strings.Join(in.cmd.Args, " "), e)
+		}
+	}
+	return err
+}
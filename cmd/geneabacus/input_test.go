@@ -0,0 +1,131 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+)
+
+func TestOpenSAMInput(t *testing.T) {
+	content := []byte("@SQ\tSN:chr1\tLN:1000\nr1\t0\tchr1\t101\t255\t10M\t*\t0\t0\tAAAAAAAAAA\t*\n")
+	tests := []struct {
+		name     string
+		compress func(io.Writer) (io.WriteCloser, error)
+	}{
+		{"plain", nil},
+		{"gzip", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }},
+		{"zstd", func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }},
+		{"lz4", func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil }},
+		{"xz", func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }},
+	}
+	for _, tt := range tests {
+		for _, truncated := range []bool{false, true} {
+			if truncated && tt.compress == nil {
+				continue
+			}
+			name := tt.name
+			if truncated {
+				name += " truncated"
+			}
+			t.Run(name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if tt.compress == nil {
+					buf.Write(content)
+				} else {
+					w, err := tt.compress(&buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err = w.Write(content); err != nil {
+						t.Fatal(err)
+					}
+					if err = w.Close(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				data := buf.Bytes()
+				if truncated {
+					data = data[:len(data)/2]
+				}
+				path := filepath.Join(t.TempDir(), "r.sam")
+				if err := os.WriteFile(path, data, 0666); err != nil {
+					t.Fatal(err)
+				}
+				in, err := OpenSAMInput(path, nil)
+				if err != nil {
+					if truncated {
+						return
+					}
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(in)
+				if e := in.Close(); err == nil {
+					err = e
+				}
+				// Truncated input must fail when reading or closing
+				if truncated {
+					if err == nil {
+						t.Errorf("got no error, read %q", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, content) {
+					t.Errorf("got %q, want %q", got, content)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenSAMInputCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "r.sam")
+	content := []byte("r1\t4\t*\t0\t0\t*\t*\t0\t0\tAAAAAAAAAA\t*\n")
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cmd     []string
+		want    []byte
+		wantErr bool
+	}{
+		{"cat", []string{"cat"}, content, false},
+		{"failed", []string{"false"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := OpenSAMInput(path, tt.cmd)
+			if err != nil {
+				t.Skip(err)
+			}
+			got, err := io.ReadAll(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = in.Close(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
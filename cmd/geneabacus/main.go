@@ -49,65 +49,114 @@ func main() {
 	flag.BoolVar(&verbose, "verbose", false, "Verbose")
 	flag.BoolVar(&printVersion, "version", false, "Print version and quit")
 	// Arguments: Input
-	var pathSAMsRaw, pathBAMsRaw, rawSAMCmdIn, pathFeatures, formatFeatures, fonName, fonChrom, fonStrand, fonCoords, featureStrandRaw, pathFeaturesFilter, formatFeaturesFilter, fonNameFilter, fonChromFilter, fonStrandFilter, fonCoordsFilter, featureStrandRawFilter, libraryR1StrandRaw string
+	var pathSAMsRaw, pathBAMsRaw, rawSAMCmdIn, pathFeatures, formatFeatures, fonName, fonChrom, fonStrand, fonCoords, fonGroup, fonCDSStart, fonCDSEnd, gffGroup, gffType, featureStrandRaw, pathFeaturesFilter, formatFeaturesFilter, fonNameFilter, fonChromFilter, fonStrandFilter, fonCoordsFilter, gffGroupFilter, gffTypeFilter, featureStrandRawFilter, libraryR1StrandRaw string
 	var ignoreNHTag, paired, includeMissingInFilter bool
+	var mateBufferSize int
+	var useBAMIndex bool
 	flag.StringVar(&pathSAMsRaw, "path_sam", "", "Path to SAM file(s) (comma separated)")
 	flag.StringVar(&pathBAMsRaw, "path_bam", "", "Path to BAM file(s) (comma separated)")
-	flag.StringVar(&rawSAMCmdIn, "sam_command_in", "", "Command line to execute for opening each of the SAM file (comma separated)")
+	flag.BoolVar(&useBAMIndex, "use_bam_index", false, "Only read regions overlapping features using BAM index (.bai or .csi next to BAM file) for single-end coordinate-sorted BAM (full scan otherwise)")
+	flag.StringVar(&rawSAMCmdIn, "sam_command_in", "", "Command line to execute for opening each of the SAM file (comma separated) instead of built-in decompression of gzip, Zstandard, LZ4 and xz")
 	flag.StringVar(&pathFeatures, "path_features", "", "Path to features file")
-	flag.StringVar(&formatFeatures, "format_features", "FON", "Format of features file: 'FON' or 'tab'")
+	flag.StringVar(&formatFeatures, "format_features", "FON", "Format of features file: 'FON', 'GTF', 'GFF3', 'BED' or 'tab'")
 	flag.StringVar(&fonName, "fon_name", "transcript_stable_id", "FON key for feature name")
 	flag.StringVar(&fonChrom, "fon_chrom", "chrom", "FON key for chromosome or locus")
 	flag.StringVar(&fonStrand, "fon_strand", "strand", "FON key for strand")
 	flag.StringVar(&fonCoords, "fon_coords", "exons", "FON key for coordinates (exons for example)")
+	flag.StringVar(&fonGroup, "fon_group", "", "FON key for feature group (gene_stable_id for example) to output group counts")
+	flag.StringVar(&fonCDSStart, "fon_cds_start", "", "FON key for CDS genomic start (cds_start for example)")
+	flag.StringVar(&fonCDSEnd, "fon_cds_end", "", "FON key for CDS genomic end (cds_end for example)")
+	flag.StringVar(&gffGroup, "gff_group", "transcript_id", "GTF/GFF3 attribute to group records into feature (transcript_id or gene_id for example)")
+	flag.StringVar(&gffType, "gff_type", "exon", "GTF/GFF3 record type used for coordinates (exon, CDS or five_prime_UTR for example)")
 	flag.StringVar(&featureStrandRaw, "feature_strand", "+", "Default feature strand (+ (+1) or - (-1))")
 	flag.StringVar(&pathFeaturesFilter, "path_features_filter", "", "Path to features file (Filter)")
-	flag.StringVar(&formatFeaturesFilter, "format_features_filter", "FON", "Format of features for Filter: 'FON' or 'tab'")
+	flag.StringVar(&formatFeaturesFilter, "format_features_filter", "FON", "Format of features for Filter: 'FON', 'GTF', 'GFF3', 'BED' or 'tab'")
 	flag.StringVar(&fonNameFilter, "fon_name_filter", "transcript_stable_id", "FON key for feature name for Filter")
 	flag.StringVar(&fonChromFilter, "fon_chrom_filter", "chrom", "FON key for chromosome or locus for Filter")
 	flag.StringVar(&fonStrandFilter, "fon_strand_filter", "strand", "FON key for strand for Filter")
 	flag.StringVar(&fonCoordsFilter, "fon_coords_filter", "exons", "FON key for coordinates (exons for example) for Filter")
+	flag.StringVar(&gffGroupFilter, "gff_group_filter", "transcript_id", "GTF/GFF3 attribute to group records into feature for Filter")
+	flag.StringVar(&gffTypeFilter, "gff_type_filter", "exon", "GTF/GFF3 record type used for coordinates for Filter")
 	flag.StringVar(&featureStrandRawFilter, "feature_strand_filter", "+", "Default feature strand for Filter (+ (+1) or - (-1))")
 	flag.StringVar(&libraryR1StrandRaw, "read_strand", "", "Read 1 strand, i.e. + (+1) or - (-1) or unstranded if empty")
 	flag.BoolVar(&paired, "paired", false, "Pair-end sequencing")
+	flag.IntVar(&mateBufferSize, "mate_buffer_size", 1000000, "Maximum number of reads waiting for their mate in memory before spilling to disk (coordinate-sorted pair-end input)")
 	flag.BoolVar(&ignoreNHTag, "ignore_nh_tag", false, "Ignore NH SAM tag and consider all alignment unique")
 	flag.BoolVar(&includeMissingInFilter, "include_missing_in_filter", false, "Include missing feature in filter (present in main feature) as is")
 	// Arguments: Read selection
 	var minMappingQualityRaw, minOverlap, fragmentMinLength, fragmentMaxLength int
-	var readLengthsRaw string
+	var readLengthsRaw, overlapModeRaw, multiModeRaw, alignmentSelectRaw string
 	var randProportionRaw float64
-	var inProperPair bool
+	var inProperPair, overlapJunction bool
 	flag.IntVar(&minMappingQualityRaw, "read_min_mapping_quality", 0, "Minimum read mapping quality")
 	flag.IntVar(&minOverlap, "read_min_overlap", 10, "Minimum total overlap of the read with the feature interval(s)")
+	flag.BoolVar(&overlapJunction, "overlap_junction", false, "Only assign spliced read to feature with intron(s) matching the read junction(s)")
+	flag.StringVar(&overlapModeRaw, "overlap_mode", "all", "Assignment of read overlapping several features: 'all', 'union', 'intersection-strict', 'intersection-nonempty', 'fractional' or 'drop'")
+	flag.StringVar(&alignmentSelectRaw, "alignment_select", "all", "Selection of read alignments: 'all', 'no-secondary' (remove secondary alignments), 'primary' (only primary alignment counted as unique) or 'best' (alignment(s) with highest AS tag, requires alignments grouped by read name)")
+	flag.StringVar(&multiModeRaw, "multi_mode", "uniform", "Weight of multi-mapping read alignments: 'uniform' (1/NH) or 'em' (redistributed by expectation-maximization using feature abundances)")
 	flag.IntVar(&fragmentMinLength, "fragment_min_length", 0, "Minimum fragment length")
 	flag.IntVar(&fragmentMaxLength, "fragment_max_length", 0, "Maximum fragment length")
 	flag.StringVar(&readLengthsRaw, "read_length", "", "Read length(s) (comma separated)")
 	flag.Float64Var(&randProportionRaw, "rand_proportion", -1., "Randomly select a proportion of all reads (from 0. to 1.)")
 	flag.BoolVar(&inProperPair, "read_in_proper_pair", false, "Only read in proper pair (default: all pairs)")
 	// Arguments: Counting
-	var countPath, countMultisRaw, countTotalsRaw string
-	var countTotalRealRead, countInProfile bool
+	var countPath, countGroupPath, junctionPath, cellPath, cellBarcodeTag, cellUMITag, cellWhitelistPath, umiSource, countMultisRaw, countUnitsRaw, countTotalsRaw string
+	var countTotalRealRead, countInProfile, countIntron bool
+	var cellMulti int
 	flag.StringVar(&countPath, "count_path", "counts.csv", "Path to counts output")
+	flag.StringVar(&countGroupPath, "count_group_path", "counts_group.csv", "Path to group counts output (see fon_group option, or gene with GTF/GFF3 features)")
+	flag.StringVar(&junctionPath, "junction_path", "", "Path to splice junction counts output")
+	flag.StringVar(&cellPath, "cell_path", "", "Path to directory for single-cell UMI counts output (matrix.mtx, barcodes.tsv and features.tsv) replacing counts output")
+	flag.StringVar(&cellBarcodeTag, "cell_barcode_tag", "CB", "SAM tag of cell barcode")
+	flag.StringVar(&cellUMITag, "cell_umi_tag", "UB", "SAM tag of UMI")
+	flag.StringVar(&cellWhitelistPath, "cell_whitelist", "", "Path to cell barcode whitelist (one barcode per line)")
+	flag.IntVar(&cellMulti, "cell_multi", 1, "Maximum alignment multiplicity to include a read in single-cell counts")
+	flag.StringVar(&umiSource, "umi_source", "", "Deduplicate reads using UMI from read name ('name', UMI after last _ or :) or from SAM tag (RX for example)")
 	flag.StringVar(&countMultisRaw, "count_multis", "1,2,900", "Read multiplicity to use for counting (comma separated)")
+	flag.StringVar(&countUnitsRaw, "count_units", "rpkm", "Normalized count unit(s): 'rpkm', 'tpm', 'cpm' or 'raw' (comma separated)")
 	flag.StringVar(&countTotalsRaw, "count_totals", "", "Totals (i.e. library size) for normalization (comma separated)")
 	flag.BoolVar(&countTotalRealRead, "count_total_real_read", false, "Total read count is total number of read weighted (false) or not (true) by their multiplicity")
 	flag.BoolVar(&countInProfile, "count_in_profile", false, "Only count reads included in the profile")
+	flag.BoolVar(&countIntron, "count_intron", false, "Add exonic, intronic and spanning counts (introns are gaps between feature intervals)")
 	// Arguments: Profiling
-	var profilePathsRaw, profileTypeRaw, profileFormatsRaw string
-	var profileMulti, profileOverhang, profileUntemplated, profileExtensionLength int
+	var profilePathsRaw, profileTypeRaw, profileFormatsRaw, profileOffsetsPath string
+	var profileMulti, profileOverhang, profileUntemplated, profileExtensionLength, profileRTShift int
 	var profilePositionFraction float64
-	var profileNoUntemplated, profileNorm, profileNoCoordMapping bool
+	var profileNoUntemplated, profileNorm, profileNoCoordMapping, profileStranded, profileMinusNegative bool
 	flag.StringVar(&profilePathsRaw, "profile_paths", "profiles.bedgraph", "Path to profile output(s) (comma separated)")
-	flag.StringVar(&profileTypeRaw, "profile_type", "", "Computing profiles of read distribution: 'first', 'last', 'first-last', 'position', 'all', 'all-extension' or 'all-slice'")
-	flag.StringVar(&profileFormatsRaw, "profile_formats", "bedgraph", "Profile output format: 'bedgraph', 'binary' or 'csv' (comma separated)")
+	flag.StringVar(&profileTypeRaw, "profile_type", "", "Computing profiles of read distribution: 'first', 'last', 'first-last', 'position', 'all', 'all-extension', 'all-slice', 'frame', 'mismatch', 'rt-stop', 'base', 'insertion' or 'deletion'")
+	flag.StringVar(&profileFormatsRaw, "profile_formats", "bedgraph", "Profile output format: 'bedgraph', 'bigwig', 'binary' or 'csv' (comma separated)")
 	flag.IntVar(&profileMulti, "profile_multi", 900, "Maximum alignment multiplicity to include a read in profile")
 	flag.IntVar(&profileOverhang, "profile_overhang", 0, "Overhang length to add to each side of the profile")
 	flag.IntVar(&profileUntemplated, "profile_untemplated", 0, "Remove max untemplated nucleotide")
+	flag.StringVar(&profileOffsetsPath, "profile_offsets", "", "Path to read position offsets (P-site for example) per read length (tabulated file with read length, offset and optionally anchor 5 or 3) for first and last profiles")
 	flag.IntVar(&profileExtensionLength, "profile_extension_length", 0, "Extension length for extension profile")
+	flag.IntVar(&profileRTShift, "profile_rt_shift", -1, "Shift of reverse-transcription stop from read 5' end (negative upstream) for rt-stop profile")
 	flag.Float64Var(&profilePositionFraction, "profile_position_fraction", 0.5, "Fraction of position between start and end for position profile")
 	flag.BoolVar(&profileNoUntemplated, "profile_no_untemplated", false, "Include only read w/o untemplated nucleotide in profile")
 	flag.BoolVar(&profileNorm, "profile_norm", false, "Normalize profile counts with total reads")
 	flag.BoolVar(&profileNoCoordMapping, "profile_no_coord_mapping", false, "Skip coordinate mapping from input to feature. Option specific to input and feature with the same coordinate system (e.g. genomic) only producing profile sense to the input. Used for genomic profile.")
+	flag.BoolVar(&profileStranded, "profile_stranded", false, "Separate profiles by strand: each feature is duplicated on the opposite strand and profiles are written to .plus and .minus output paths")
+	flag.BoolVar(&profileMinusNegative, "profile_minus_negative", false, "Output minus strand profiles (see profile_stranded option) with negative values")
+	// Arguments: Metagene
+	var metagenePath, metageneLandmarksRaw, metageneAggregate string
+	var metageneWindow int
+	var metageneNorm bool
+	flag.StringVar(&metagenePath, "metagene_path", "", "Path to metagene output (profiles aggregated around landmarks)")
+	flag.StringVar(&metageneLandmarksRaw, "metagene_landmarks", "start,end", "Metagene landmarks: 'start', 'end', 'cds_start' or 'cds_end' (comma separated)")
+	flag.IntVar(&metageneWindow, "metagene_window", 50, "Window around metagene landmarks")
+	flag.BoolVar(&metageneNorm, "metagene_norm", false, "Normalize each feature profile by its mean before metagene aggregation")
+	flag.StringVar(&metageneAggregate, "metagene_aggregate", "sum", "Metagene aggregation of feature profiles: 'sum' or 'mean'")
+	// Arguments: Frame
+	var framePath, frameLengthPath string
+	flag.StringVar(&framePath, "frame_path", "frames.csv", "Path to frame counts per feature output (see frame profile type)")
+	flag.StringVar(&frameLengthPath, "frame_length_path", "frames_length.csv", "Path to frame counts per read length output (see frame profile type)")
+	// Arguments: Offset estimation
+	var offsetEstimatePath, offsetMetagenePath string
+	var offsetWindow int
+	flag.StringVar(&offsetEstimatePath, "offset_estimate_path", "", "Path to output offsets per read length estimated from read 5' end around CDS start (see profile_offsets option)")
+	flag.StringVar(&offsetMetagenePath, "offset_metagene_path", "", "Path to output metagene of read 5' end around CDS start per read length (CSV, or JSON with .json extension)")
+	flag.IntVar(&offsetWindow, "offset_window", 30, "Window around CDS start for offset estimation")
 	// Arguments: Output
 	var pathMapping, pathSAMOutRaw string
 	flag.StringVar(&pathMapping, "path_mapping", "", "Path to feature name(s) mapping (tabulated file)")
@@ -204,12 +253,57 @@ func main() {
 			fmt.Printf("%.1fmin - Keeping fragment with max length %v\n", timeNow.Sub(timeStart).Minutes(), fragmentMaxLength)
 		}
 	}
+	// overlapMode
+	var overlapMode int
+	switch overlapModeRaw {
+	case "all":
+		overlapMode = feature.OverlapModeAll
+	case "union":
+		overlapMode = feature.OverlapModeUnion
+	case "intersection-strict":
+		overlapMode = feature.OverlapModeIntersectionStrict
+	case "intersection-nonempty":
+		overlapMode = feature.OverlapModeIntersectionNonempty
+	case "fractional":
+		overlapMode = feature.OverlapModeFractional
+	case "drop":
+		overlapMode = feature.OverlapModeDrop
+	default:
+		log.Fatalln("Unknown overlap mode", overlapModeRaw)
+	}
+	// alignmentSelect
+	var alignmentSelect int
+	switch alignmentSelectRaw {
+	case "all":
+		alignmentSelect = AlignmentSelectAll
+	case "no-secondary":
+		alignmentSelect = AlignmentSelectNoSecondary
+	case "primary":
+		alignmentSelect = AlignmentSelectPrimary
+	case "best":
+		alignmentSelect = AlignmentSelectBest
+	default:
+		log.Fatalln("Unknown alignment selection", alignmentSelectRaw)
+	}
+	// multiMode
+	var multiMode int
+	switch multiModeRaw {
+	case "uniform":
+		multiMode = MultiModeUniform
+	case "em":
+		multiMode = MultiModeEM
+	default:
+		log.Fatalln("Unknown multi mode", multiModeRaw)
+	}
 	// minMappingQuality
 	var minMappingQuality byte
 	minMappingQuality = byte(minMappingQualityRaw)
 	// randProportion
 	var randProportion float32
 	randProportion = float32(randProportionRaw)
+	if multiMode == MultiModeEM && randProportion > 0. {
+		log.Fatal("-rand_proportion can't be used with -multi_mode em (reads are randomly selected independently in each pass)")
+	}
 	// countMultis
 	var countMultis []int
 	var profileMultiTotalCol int
@@ -229,9 +323,25 @@ func main() {
 		countMultis = append(countMultis, profileMulti)
 		profileMultiTotalCol = len(countMultis) - 1
 	}
-	profileMultiTotalCol = 1 + (2 * profileMultiTotalCol)
+	// countUnits
+	var countUnits []int
+	for _, u := range strings.Split(countUnitsRaw, ",") {
+		switch strings.ToLower(u) {
+		case "rpkm":
+			countUnits = append(countUnits, feature.CountUnitRPKM)
+		case "tpm":
+			countUnits = append(countUnits, feature.CountUnitTPM)
+		case "cpm":
+			countUnits = append(countUnits, feature.CountUnitCPM)
+		case "raw", "":
+		default:
+			log.Fatalln("Unknown count unit", u)
+		}
+	}
+	countStride := 1 + len(countUnits)
+	profileMultiTotalCol = 1 + (countStride * profileMultiTotalCol)
 	// countTotals
-	countTotals := make([]float64, 1+len(countMultis)*2)
+	countTotals := make([]float64, 1+len(countMultis)*countStride)
 	countTotalInput := false
 	if countTotalsRaw != "" {
 		nTotal := 0
@@ -240,7 +350,7 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
-			countTotals[1+(2*it)] = tf
+			countTotals[1+(countStride*it)] = tf
 			nTotal += 1
 		}
 		if nTotal != len(countMultis) {
@@ -248,6 +358,37 @@ func main() {
 		}
 		countTotalInput = true
 	}
+	// countGroupPath (GTF/GFF3 features are grouped by gene)
+	hasGroup := fonGroup != ""
+	switch strings.ToLower(formatFeatures) {
+	case "gtf", "gff3", "gff":
+		hasGroup = true
+	}
+	if !hasGroup {
+		countGroupPath = ""
+	}
+	// Single-cell counts
+	var cellBarcodes map[string]bool
+	if cellPath != "" {
+		if len(cellBarcodeTag) != 2 || len(cellUMITag) != 2 {
+			log.Fatal("Cell barcode and UMI tags must be two characters long")
+		}
+		if cellMulti < 1 {
+			log.Fatal("Cell multiplicity must be at least 1")
+		}
+		if cellWhitelistPath != "" {
+			var err error
+			cellBarcodes, err = feature.OpenBarcodes(cellWhitelistPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		countPath = ""
+	}
+	// UMI deduplication
+	if umiSource != "" && umiSource != "name" && len(umiSource) != 2 {
+		log.Fatal("UMI source must be 'name' or a two characters long SAM tag")
+	}
 	// profileType
 	var profileType int
 	switch profileTypeRaw {
@@ -265,12 +406,87 @@ func main() {
 		profileType = profile.ProfileTypeSplice
 	case "all-extension":
 		profileType = profile.ProfileTypeExtension
+	case "frame":
+		profileType = profile.ProfileTypeFrame
+	case "mismatch":
+		profileType = profile.ProfileTypeMismatch
+	case "rt-stop":
+		profileType = profile.ProfileTypeRTStop
+	case "base":
+		profileType = profile.ProfileTypeBase
+	case "insertion":
+		profileType = profile.ProfileTypeInsertion
+	case "deletion":
+		profileType = profile.ProfileTypeDeletion
 	default:
 		profileType = profile.ProfileTypeNone
 	}
 	// Check arguments
-	if (profileType == profile.ProfileTypeFirst || profileType == profile.ProfileTypeLast) && libraryR1Strand == 0 {
-		log.Fatal("First and last position profile require stranded library (see read_strand option)")
+	if (profileType == profile.ProfileTypeFirst || profileType == profile.ProfileTypeLast || profileType == profile.ProfileTypeFrame || profileType == profile.ProfileTypeRTStop) && libraryR1Strand == 0 {
+		log.Fatal("First, last position, frame and rt-stop profile require stranded library (see read_strand option)")
+	}
+	if profileType == profile.ProfileTypeFrame && profileNoCoordMapping {
+		log.Fatal("Frame profile requires coordinate mapping to features with CDS")
+	}
+	if profileStranded && libraryR1Strand == 0 {
+		log.Fatal("Stranded profiles require stranded library (see read_strand option)")
+	}
+	// profileOffsets
+	var profileOffsets *profile.Offsets
+	if profileOffsetsPath != "" {
+		if profileType != profile.ProfileTypeFirst && profileType != profile.ProfileTypeLast && profileType != profile.ProfileTypeFrame {
+			log.Fatal("Offsets require first, last position or frame profile (see profile_offsets option)")
+		}
+		var err error
+		profileOffsets, err = profile.OpenOffsets(profileOffsetsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ((profileType == profile.ProfileTypeFirst || profileType == profile.ProfileTypeFrame) && len(profileOffsets.Five) == 0) || (profileType == profile.ProfileTypeLast && len(profileOffsets.Three) == 0) {
+			log.Fatalln("No offset found for profile in", profileOffsetsPath)
+		}
+	}
+	// Metagene
+	var metageneLandmarks []int
+	var metageneMean bool
+	if metagenePath != "" {
+		if profileType == profile.ProfileTypeNone {
+			log.Fatal("Metagene requires profile (see profile_type option)")
+		}
+		if profileNoCoordMapping {
+			log.Fatal("Metagene requires coordinate mapping to features")
+		}
+		if len(profile.ProfileChannelNames[profileType]) > 0 {
+			log.Fatal("Metagene requires profile with one value per position")
+		}
+		for _, l := range strings.Split(metageneLandmarksRaw, ",") {
+			found := false
+			for il, name := range profile.MetageneLandmarkNames {
+				if l == name {
+					metageneLandmarks = append(metageneLandmarks, il)
+					found = true
+				}
+			}
+			if !found {
+				log.Fatalln("Unknown metagene landmark", l)
+			}
+		}
+		switch metageneAggregate {
+		case "sum":
+		case "mean":
+			metageneMean = true
+		default:
+			log.Fatalln("Unknown metagene aggregation", metageneAggregate)
+		}
+	}
+	// Offset estimation
+	if offsetEstimatePath != "" || offsetMetagenePath != "" {
+		if libraryR1Strand == 0 {
+			log.Fatal("Offset estimation requires stranded library (see read_strand option)")
+		}
+		if profileNoCoordMapping {
+			log.Fatal("Offset estimation requires coordinate mapping to features with CDS")
+		}
 	}
 	// profilePaths
 	var profilePaths []string
@@ -284,13 +500,42 @@ func main() {
 	var err error
 	switch strings.ToLower(formatFeatures) {
 	case "fon":
-		features, err = feature.OpenFON(pathFeatures, fonName, fonChrom, fonStrand, fonCoords)
+		features, err = feature.OpenFON(pathFeatures, fonName, fonChrom, fonStrand, fonCoords, fonGroup, fonCDSStart, fonCDSEnd)
+	case "gtf":
+		features, err = feature.OpenGTF(pathFeatures, gffGroup, gffType, parseStrand(featureStrandRaw))
+	case "gff3", "gff":
+		features, err = feature.OpenGFF3(pathFeatures, gffGroup, gffType, parseStrand(featureStrandRaw))
+	case "bed":
+		features, err = feature.OpenBED(pathFeatures, parseStrand(featureStrandRaw))
 	case "tab":
 		features, err = feature.OpenTAB(pathFeatures, parseStrand(featureStrandRaw))
+	default:
+		log.Fatalln("Unknown feature format", formatFeatures)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Check CDS
+	if profileType == profile.ProfileTypeFrame || offsetEstimatePath != "" || offsetMetagenePath != "" {
+		withCDS := false
+		for _, feat := range features {
+			if feat.CDS != nil {
+				withCDS = true
+				break
+			}
+		}
+		if !withCDS {
+			log.Fatal("Frame profile and offset estimation require features with CDS (see fon_cds_start option)")
+		}
+	}
+	// Duplicate features on opposite strand
+	nFeature := uint32(len(features))
+	if profileStranded {
+		features, err = feature.StrandTwins(features, nFeature)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Open filter features
 	var trees map[string]map[int8]*interval.IntTree
@@ -300,15 +545,23 @@ func main() {
 		var err error
 		switch strings.ToLower(formatFeaturesFilter) {
 		case "fon":
-			featuresFilterRaw, err = feature.OpenFON(pathFeaturesFilter, fonNameFilter, fonChromFilter, fonStrandFilter, fonCoordsFilter)
+			featuresFilterRaw, err = feature.OpenFON(pathFeaturesFilter, fonNameFilter, fonChromFilter, fonStrandFilter, fonCoordsFilter, "", "", "")
+		case "gtf":
+			featuresFilterRaw, err = feature.OpenGTF(pathFeaturesFilter, gffGroupFilter, gffTypeFilter, parseStrand(featureStrandRawFilter))
+		case "gff3", "gff":
+			featuresFilterRaw, err = feature.OpenGFF3(pathFeaturesFilter, gffGroupFilter, gffTypeFilter, parseStrand(featureStrandRawFilter))
+		case "bed":
+			featuresFilterRaw, err = feature.OpenBED(pathFeaturesFilter, parseStrand(featureStrandRawFilter))
 		case "tab":
 			featuresFilterRaw, err = feature.OpenTAB(pathFeaturesFilter, parseStrand(featureStrandRawFilter))
+		default:
+			log.Fatalln("Unknown feature format", formatFeaturesFilter)
 		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		// Check feature has corresponding filter-feature
-		for _, feat := range features {
+		for _, feat := range features[:nFeature] {
 			found := false
 			for _, featf := range featuresFilterRaw {
 				if feat.Name == featf.Name {
@@ -324,7 +577,7 @@ func main() {
 				}
 			}
 			if includeMissingInFilter && !found {
-				fmt.Println("Warning: %s not found in filter, adding in filter as is", feat.Name)
+				fmt.Printf("Warning: %s not found in filter, adding in filter as is\n", feat.Name)
 				featuresMissing = append(featuresMissing, feat)
 			}
 		}
@@ -335,15 +588,22 @@ func main() {
 			feat.ID = maxID
 			featuresFilter = append(featuresFilter, feat)
 		}
+		// Duplicate filter features on opposite strand
+		if profileStranded {
+			featuresFilter, err = feature.StrandTwins(featuresFilter, nFeature)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 		// Build feature trees
-		trees, err = feature.BuildFeatTrees(featuresFilter)
+		trees, err = feature.BuildFeatTrees(featuresFilter, countIntron)
 		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
 		var err error
 		// Build feature trees
-		trees, err = feature.BuildFeatTrees(features)
+		trees, err = feature.BuildFeatTrees(features, countIntron)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -364,8 +624,112 @@ func main() {
 		pathSAMOut = esam.PathSAM{Path: pathSAMOutRaw, Binary: false}
 	}
 
+	// Profile & count options
+	opt := PConOptions{
+		ReadLengths:             readLengths,
+		FragmentMinLength:       fragmentMinLength,
+		FragmentMaxLength:       fragmentMaxLength,
+		RandProportion:          randProportion,
+		Paired:                  paired,
+		LibraryR1Strand:         libraryR1Strand,
+		IgnoreNHTag:             ignoreNHTag,
+		AlignmentSelect:         alignmentSelect,
+		MateBufferSize:          mateBufferSize,
+		UseBAMIndex:             useBAMIndex,
+		InProperPair:            inProperPair,
+		MinMappingQuality:       minMappingQuality,
+		MinOverlap:              minOverlap,
+		OverlapMode:             overlapMode,
+		OverlapJunction:         overlapJunction,
+		CountMultis:             countMultis,
+		CountUnits:              countUnits,
+		CountTotals:             countTotals,
+		CountTotalInput:         countTotalInput,
+		CountTotalRealRead:      countTotalRealRead,
+		CountInProfile:          countInProfile,
+		CountIntron:             countIntron,
+		CountPath:               countPath,
+		CountGroupPath:          countGroupPath,
+		JunctionPath:            junctionPath,
+		CellPath:                cellPath,
+		CellBarcodeTag:          cellBarcodeTag,
+		CellUMITag:              cellUMITag,
+		CellBarcodes:            cellBarcodes,
+		CellMulti:               cellMulti,
+		UMISource:               umiSource,
+		ProfileType:             profileType,
+		ProfileMulti:            profileMulti,
+		ProfileOverhang:         profileOverhang,
+		ProfileNoCoordMapping:   profileNoCoordMapping,
+		ProfileStranded:         profileStranded,
+		ProfileMinusNegative:    profileMinusNegative,
+		ProfileUntemplated:      profileUntemplated,
+		ProfileNoUntemplated:    profileNoUntemplated,
+		ProfileOffsets:          profileOffsets,
+		ProfileExtensionLength:  profileExtensionLength,
+		ProfilePositionFraction: profilePositionFraction,
+		ProfileRTShift:          profileRTShift,
+		ProfileNorm:             profileNorm,
+		ProfileMultiTotalCol:    profileMultiTotalCol,
+		ProfilePaths:            profilePaths,
+		ProfileFormats:          profileFormats,
+		OffsetEstimatePath:      offsetEstimatePath,
+		OffsetMetagenePath:      offsetMetagenePath,
+		OffsetWindow:            offsetWindow,
+		FramePath:               framePath,
+		FrameLengthPath:         frameLengthPath,
+		MetagenePath:            metagenePath,
+		MetageneLandmarks:       metageneLandmarks,
+		MetageneWindow:          metageneWindow,
+		MetageneNorm:            metageneNorm,
+		MetageneMean:            metageneMean,
+		AppendOutput:            appendOutput,
+		PathReport:              pathReport,
+		PathSAMOut:              pathSAMOut,
+		NWorker:                 nWorker,
+		VerboseLevel:            verboseLevel,
+	}
+
+	// Multi-mapping reads redistributed by EM: first pass recording features of multi-mapping reads
+	var multiEM *MultiEM
+	if multiMode == MultiModeEM {
+		if verboseLevel > 0 {
+			timeNow := time.Now()
+			fmt.Printf("%.1fmin - Collecting multi-mapping reads for EM\n", timeNow.Sub(timeStart).Minutes())
+		}
+		multiEM = NewMultiEM(len(features))
+		// Collecting pass without output
+		collect := opt
+		collect.CountTotals = make([]float64, len(countTotals))
+		collect.CountTotalInput = false
+		collect.CountTotalRealRead = false
+		collect.CountInProfile = false
+		collect.CountPath = ""
+		collect.CountGroupPath = ""
+		collect.JunctionPath = ""
+		collect.CellPath = ""
+		collect.ProfileType = profile.ProfileTypeNone
+		collect.ProfileNorm = false
+		collect.OffsetEstimatePath = ""
+		collect.OffsetMetagenePath = ""
+		collect.FramePath = ""
+		collect.FrameLengthPath = ""
+		collect.MetagenePath = ""
+		collect.PathReport = ""
+		collect.PathSAMOut = esam.PathSAM{}
+		_, err = PConFeature(pathSAMs, SAMCmdIn, features, featuresMapping, trees, multiEM, collect, timeStart)
+		if err != nil {
+			log.Fatal(err)
+		}
+		iteration := multiEM.Estimate(features)
+		if verboseLevel > 0 {
+			timeNow := time.Now()
+			fmt.Printf("%.1fmin - EM done in %d iteration(s)\n", timeNow.Sub(timeStart).Minutes(), iteration)
+		}
+	}
+
 	// Profile & Count alignments on Features
-	nAlign, err := PConFeature(pathSAMs, SAMCmdIn, features, featuresMapping, trees, readLengths, fragmentMinLength, fragmentMaxLength, randProportion, paired, libraryR1Strand, ignoreNHTag, inProperPair, minMappingQuality, minOverlap, countMultis, countTotals, countTotalInput, countTotalRealRead, countInProfile, countPath, profileType, profileMulti, profileOverhang, profileNoCoordMapping, profileUntemplated, profileNoUntemplated, profileExtensionLength, profilePositionFraction, profileNorm, profileMultiTotalCol, profilePaths, profileFormats, appendOutput, pathReport, pathSAMOut, nWorker, timeStart, verboseLevel)
+	nAlign, err := PConFeature(pathSAMs, SAMCmdIn, features, featuresMapping, trees, multiEM, opt, timeStart)
 	if err != nil {
 		log.Fatal(err)
 	}
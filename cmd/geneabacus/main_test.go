@@ -0,0 +1,454 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests if GENEABACUS_TEST_MAIN is set (see runMain).
+func TestMain(m *testing.M) {
+	if os.Getenv("GENEABACUS_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs geneabacus with args in a new process.
+func runMain(t *testing.T, args ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GENEABACUS_TEST_MAIN=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+// writeTestFile writes lines to name in dir and returns its path. Fields of SAM lines are separated by spaces and converted to tabs.
+func writeTestFile(t *testing.T, dir string, name string, lines ...string) string {
+	t.Helper()
+	if strings.HasSuffix(name, ".sam") {
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.Fields(line), "\t")
+		}
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readCounts reads a count file and returns the values per feature name and column name.
+func readCounts(t *testing.T, path string) map[string]map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]map[string]string)
+	for _, record := range records[1:] {
+		counts[record[0]] = make(map[string]string)
+		for i, col := range records[0] {
+			counts[record[0]][col] = record[i]
+		}
+	}
+	return counts
+}
+
+// readReport reads a report and returns its counts.
+func readReport(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := make(map[string]interface{})
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCountIntron(t *testing.T) {
+	dir := t.TempDir()
+	// A has intron [200,300). Introns of B [1100,1200) and C [1060,1250) overlap.
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200], [300, 400]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100], [1200, 1300]]},
+		{"transcript_stable_id": "C", "chrom": "chr1", "strand": "+", "exons": [[1050, 1060], [1250, 1260]]}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// Exonic in A
+		"r1 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Intronic in A
+		"r2 0 chr1 231 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Spanning exon and intron of A
+		"r3 0 chr1 191 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Intronic in A with 2 alignments
+		"r4 0 chr1 261 255 20M * 0 0 "+seq+" * NH:i:2",
+		// Intronic in B and C
+		"r5 0 chr1 1151 255 20M * 0 0 "+seq+" * NH:i:1",
+	)
+	tests := []struct {
+		overlapMode string
+		// exonic_2, intronic_2 and spanning_2 of A, B and C
+		want map[string][]string
+		// Unique reads in library total
+		unique float64
+	}{
+		{"all", map[string][]string{"A": {"1", "1.5", "1"}, "B": {"0", "1", "0"}, "C": {"0", "1", "0"}}, 4},
+		{"union", map[string][]string{"A": {"1", "1.5", "1"}, "B": {"0", "0", "0"}, "C": {"0", "0", "0"}}, 3},
+		{"fractional", map[string][]string{"A": {"1", "1.5", "1"}, "B": {"0", "0.5", "0"}, "C": {"0", "0.5", "0"}}, 4},
+		{"drop", map[string][]string{"A": {"1", "1.5", "1"}, "B": {"0", "0", "0"}, "C": {"0", "0", "0"}}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overlapMode, func(t *testing.T) {
+			pathCount := filepath.Join(dir, "counts_"+tt.overlapMode+".csv")
+			pathReport := filepath.Join(dir, "report_"+tt.overlapMode+".json")
+			runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-count_intron", "-count_multis", "1,2", "-read_min_overlap", "5", "-overlap_mode", tt.overlapMode, "-count_path", pathCount, "-path_report", pathReport)
+			counts := readCounts(t, pathCount)
+			for name, want := range tt.want {
+				for i, region := range []string{"exonic_2", "intronic_2", "spanning_2"} {
+					if got := counts[name][region]; got != want[i] {
+						t.Errorf("%s %s: got %s, want %s", name, region, got, want[i])
+					}
+				}
+				// Intronic read(s) are not in main counts
+				if name != "A" && counts[name]["count_2"] != "0" {
+					t.Errorf("%s count_2: got %s, want 0", name, counts[name]["count_2"])
+				}
+			}
+			report := readReport(t, pathReport)
+			if got := report["ambiguous"]; got != 1. {
+				t.Errorf("ambiguous: got %v, want 1", got)
+			}
+			// Intronic reads are included in library totals
+			if got := report["align_unique"]; got != tt.unique {
+				t.Errorf("align_unique: got %v, want %v", got, tt.unique)
+			}
+		})
+	}
+}
+
+func TestUMIDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 400]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100]]}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// Filtered by mapping quality: not used for deduplication
+		"d1_ACGT 0 chr1 111 0 20M * 0 0 "+seq+" * NH:i:1",
+		"d2_ACGT 0 chr1 111 60 20M * 0 0 "+seq+" * NH:i:1",
+		// Duplicate of d2 (same 5' end)
+		"d3_ACGT 0 chr1 111 60 10S10M * 0 0 "+seq+" * NH:i:1",
+		// Other UMI
+		"d4_GGGG 0 chr1 111 60 20M * 0 0 "+seq+" * NH:i:1",
+		// Other strand
+		"d5_ACGT 16 chr1 111 60 20M * 0 0 "+seq+" * NH:i:1",
+		// Without UMI: counted
+		"d6 0 chr1 111 60 20M * 0 0 "+seq+" * NH:i:1",
+		"d7_ACGT 0 chr1 1011 60 20M * 0 0 "+seq+" * NH:i:1",
+		// Duplicate of d7
+		"d8_ACGT 0 chr1 1011 60 20M * 0 0 "+seq+" * NH:i:1",
+	)
+	for _, nWorker := range []string{"1", "4"} {
+		t.Run("worker"+nWorker, func(t *testing.T) {
+			pathCount := filepath.Join(dir, "counts_"+nWorker+".csv")
+			pathReport := filepath.Join(dir, "report_"+nWorker+".json")
+			pathSAMOut := filepath.Join(dir, "out_"+nWorker+".sam")
+			runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-umi_source", "name", "-read_min_mapping_quality", "10", "-count_multis", "1", "-num_worker", nWorker, "-count_path", pathCount, "-path_report", pathReport, "-path_sam_out", pathSAMOut)
+			counts := readCounts(t, pathCount)
+			for name, want := range map[string]string{"A": "4", "B": "1"} {
+				if got := counts[name]["count_1"]; got != want {
+					t.Errorf("%s count_1: got %s, want %s", name, got, want)
+				}
+			}
+			report := readReport(t, pathReport)
+			if got := report["duplicate"]; got != 2. {
+				t.Errorf("duplicate: got %v, want 2", got)
+			}
+			if got, want := report["duplicate_features"], map[string]interface{}{"A": 1., "B": 1.}; !reflect.DeepEqual(got, want) {
+				t.Errorf("duplicate_features: got %v, want %v", got, want)
+			}
+			if got := report["umi_missing"]; got != 1. {
+				t.Errorf("umi_missing: got %v, want 1", got)
+			}
+			// Kept reads
+			data, err := os.ReadFile(pathSAMOut)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" && !strings.HasPrefix(line, "@") {
+					names = append(names, strings.Fields(line)[0])
+				}
+			}
+			sort.Strings(names)
+			if want := []string{"d2_ACGT", "d4_GGGG", "d5_ACGT", "d6", "d7_ACGT"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("kept reads: got %v, want %v", names, want)
+			}
+		})
+	}
+}
+
+func TestUMIDeduplicationMinOverlap(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[190, 400]]}]}`)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// Overlap with B below minimum: UMI only seen in A
+		"r1_ACGT 0 chr1 181 255 20M * 0 0 "+strings.Repeat("A", 20)+" * NH:i:1",
+		// Duplicate of r1 in A only
+		"r2_ACGT 0 chr1 181 255 60M * 0 0 "+strings.Repeat("A", 60)+" * NH:i:1",
+	)
+	pathCount := filepath.Join(dir, "counts.csv")
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-umi_source", "name", "-read_min_overlap", "15", "-count_multis", "1", "-count_path", pathCount)
+	counts := readCounts(t, pathCount)
+	for name, want := range map[string]string{"A": "1", "B": "1"} {
+		if got := counts[name]["count_1"]; got != want {
+			t.Errorf("%s count_1: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestUMIDeduplicationEM(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100]]}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		"a1_ACGT 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Duplicates of a1: not used to estimate abundances
+		"a2_ACGT 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		"a3_ACGT 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		"a4_ACGT 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		"b1_CCCC 0 chr1 1011 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Multi-mapping read on A and B
+		"m1_GGGG 0 chr1 151 255 20M * 0 0 "+seq+" * NH:i:2",
+		"m1_GGGG 256 chr1 1051 255 20M * 0 0 "+seq+" * NH:i:2",
+	)
+	pathCount := filepath.Join(dir, "counts.csv")
+	pathReport := filepath.Join(dir, "report.json")
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-umi_source", "name", "-multi_mode", "em", "-count_multis", "2", "-count_path", pathCount, "-path_report", pathReport)
+	counts := readCounts(t, pathCount)
+	for name, want := range map[string]string{"A": "1.5", "B": "1.5"} {
+		if got := counts[name]["count_em"]; got != want {
+			t.Errorf("%s count_em: got %s, want %s", name, got, want)
+		}
+	}
+	// Duplicates are reported once
+	if got := readReport(t, pathReport)["duplicate"]; got != 3. {
+		t.Errorf("duplicate: got %v, want 3", got)
+	}
+}
+
+func TestMultiModeEMStranded(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100]]}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		"b1 0 chr1 1011 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Multi-mapping read antisense to A and sense to B
+		"m1 16 chr1 151 255 20M * 0 0 "+seq+" * NH:i:2",
+		"m1 256 chr1 1051 255 20M * 0 0 "+seq+" * NH:i:2",
+	)
+	pathProfile := filepath.Join(dir, "profiles.csv")
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-read_strand", "+", "-multi_mode", "em", "-count_multis", "2", "-count_path", filepath.Join(dir, "counts.csv"), "-profile_type", "first", "-profile_stranded", "-profile_formats", "csv", "-profile_paths", pathProfile)
+	// Antisense alignment keeps its uniform weight in the minus profile
+	for _, tt := range []struct {
+		strand string
+		want   map[string]float64
+	}{
+		{"plus", map[string]float64{"A": 0, "B": 1.5}},
+		{"minus", map[string]float64{"A": 0.5, "B": 0}},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, "profiles."+tt.strand+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.SplitN(line, ",", 3)
+			var sum float64
+			for _, v := range strings.Fields(fields[2]) {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sum += f
+			}
+			if sum != tt.want[fields[0]] {
+				t.Errorf("%s %s: got %v, want %v", tt.strand, fields[0], sum, tt.want[fields[0]])
+			}
+		}
+	}
+}
+
+func TestMetageneStranded(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200]]},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100]]}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// Sense to A at start
+		"r1 0 chr1 101 255 20M * 0 0 "+seq+" * NH:i:1",
+		// Antisense to B
+		"r2 16 chr1 1001 255 20M * 0 0 "+seq+" * NH:i:1",
+	)
+	pathMetagene := filepath.Join(dir, "metagene.csv")
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-read_strand", "+", "-count_path", filepath.Join(dir, "counts.csv"), "-profile_type", "first", "-profile_stranded", "-profile_paths", filepath.Join(dir, "profiles.bedgraph"), "-metagene_path", pathMetagene, "-metagene_landmarks", "start", "-metagene_window", "2")
+	metagene := readCounts(t, pathMetagene)["start"]
+	// Twins on opposite strand are not aggregated
+	for col, want := range map[string]string{"n_feature": "2", "-1": "0", "0": "1", "1": "0"} {
+		if got := metagene[col]; got != want {
+			t.Errorf("%s: got %s, want %s", col, got, want)
+		}
+	}
+}
+
+func TestFrameLengthStranded(t *testing.T) {
+	dir := t.TempDir()
+	// A and B overlap on opposite strands
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 200]], "cds_start": 110, "cds_end": 190},
+		{"transcript_stable_id": "B", "chrom": "chr1", "strand": "-", "exons": [[100, 200]], "cds_start": 110, "cds_end": 190}]}`)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// Sense to A and antisense to B
+		"r1 0 chr1 121 255 20M * 0 0 "+seq+" * NH:i:1",
+	)
+	pathFrame := filepath.Join(dir, "frames.csv")
+	pathFrameLength := filepath.Join(dir, "frames_length.csv")
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-fon_cds_start", "cds_start", "-fon_cds_end", "cds_end", "-read_strand", "+", "-count_path", filepath.Join(dir, "counts.csv"), "-profile_type", "frame", "-profile_stranded", "-profile_paths", filepath.Join(dir, "profiles.bedgraph"), "-frame_path", pathFrame, "-frame_length_path", pathFrameLength)
+	frames := readCounts(t, pathFrame)
+	if got := frames["B_antisense"]["frame_1"]; got != "1" {
+		t.Errorf("B_antisense frame_1: got %s, want 1", got)
+	}
+	// Antisense hit not counted per read length
+	for _, key := range []string{"total", "20"} {
+		if got := readCounts(t, pathFrameLength)[key]["frame_1"]; got != "1" {
+			t.Errorf("%s frame_1: got %s, want 1", key, got)
+		}
+	}
+}
+
+func TestCountGroup(t *testing.T) {
+	dir := t.TempDir()
+	// Isoforms t1 and t2 of g1 overlap
+	pathFON := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "t1", "gene_stable_id": "g1", "chrom": "chr1", "strand": "+", "exons": [[100, 200], [300, 400]]},
+		{"transcript_stable_id": "t2", "gene_stable_id": "g1", "chrom": "chr1", "strand": "+", "exons": [[150, 250], [300, 350]]},
+		{"transcript_stable_id": "t3", "chrom": "chr1", "strand": "+", "exons": [[1000, 1100]]}]}`)
+	pathGTF := writeTestFile(t, dir, "features.gtf",
+		"chr1\tsrc\texon\t101\t200\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t1\";",
+		"chr1\tsrc\texon\t301\t400\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t1\";",
+		"chr1\tsrc\texon\t151\t250\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t2\";",
+		"chr1\tsrc\texon\t301\t350\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t2\";",
+		"chr1\tsrc\texon\t1001\t1100\t.\t+\t.\ttranscript_id \"t3\";",
+	)
+	seq := strings.Repeat("A", 20)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		// t1 and t2
+		"r1 0 chr1 161 255 20M * 0 0 "+seq+" * NH:i:1",
+		// t1
+		"r2 0 chr1 111 255 20M * 0 0 "+seq+" * NH:i:1",
+		// t1 and t2 with 2 alignments
+		"r3 0 chr1 311 255 20M * 0 0 "+seq+" * NH:i:2",
+	)
+	for _, input := range []struct {
+		name string
+		args []string
+	}{
+		{"FON", []string{"-path_features", pathFON, "-fon_group", "gene_stable_id"}},
+		// Grouped by gene_id
+		{"GTF", []string{"-path_features", pathGTF, "-format_features", "GTF"}},
+	} {
+		t.Run(input.name, func(t *testing.T) {
+			pathCount := filepath.Join(dir, "counts_"+input.name+".csv")
+			pathGroup := filepath.Join(dir, "groups_"+input.name+".csv")
+			runMain(t, append([]string{"-path_sam", pathSAM, "-count_multis", "1,2", "-count_path", pathCount, "-count_group_path", pathGroup}, input.args...)...)
+			counts := readCounts(t, pathCount)
+			groups := readCounts(t, pathGroup)
+			tests := []struct {
+				counts map[string]map[string]string
+				name   string
+				want   []string
+			}{
+				// Length, count_1 and count_2
+				{counts, "t1", []string{"200", "2", "2.5"}},
+				{counts, "t2", []string{"150", "1", "1.5"}},
+				// Union of exons and one count per read
+				{groups, "g1", []string{"250", "2", "2.5"}},
+				{groups, "t3", []string{"100", "0", "0"}},
+			}
+			for _, tt := range tests {
+				for i, col := range []string{"length", "count_1", "count_2"} {
+					if got := tt.counts[tt.name][col]; got != tt.want[i] {
+						t.Errorf("%s %s: got %s, want %s", tt.name, col, got, tt.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProfileBase(t *testing.T) {
+	dir := t.TempDir()
+	pathFeatures := writeTestFile(t, dir, "features.json", `{"fon_version": 1, "features": [
+		{"transcript_stable_id": "A", "chrom": "chr1", "strand": "+", "exons": [[100, 104]]}]}`)
+	pathSAM := writeTestFile(t, dir, "reads.sam",
+		"@SQ SN:chr1 LN:10000",
+		"r1 0 chr1 101 255 4M * 0 0 ACGG * NH:i:1",
+	)
+	runMain(t, "-path_sam", pathSAM, "-path_features", pathFeatures, "-read_min_overlap", "1", "-count_path", filepath.Join(dir, "counts.csv"), "-profile_type", "base", "-profile_formats", "csv,bedgraph", "-profile_paths", filepath.Join(dir, "profiles.csv")+","+filepath.Join(dir, "profiles.bedgraph"))
+	// Channels A, C, G and T in one CSV output
+	data, err := os.ReadFile(filepath.Join(dir, "profiles.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "A,16,1 0 0 0 0 1 0 0 0 0 1 1 0 0 0 0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// One bedGraph output per channel
+	for _, name := range []string{"A", "C", "G", "T"} {
+		if _, err := os.Stat(filepath.Join(dir, "profiles."+name+".bedgraph")); err != nil {
+			t.Error(err)
+		}
+	}
+}
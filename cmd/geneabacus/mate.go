@@ -0,0 +1,271 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+)
+
+// MateKey identifies the mates of one hit of a pair by read name, HI tag and positions of read 1 and read 2
+type MateKey struct {
+	Name string
+	HI   int
+	Ref1 int
+	Pos1 int
+	Ref2 int
+	Pos2 int
+}
+
+// MateBuffer pairs the mates of paired-end reads from coordinate-sorted input. Reads are kept until their mate is found. Reads with a mate expected before the current position (removed or missing mate) are orphans returned alone. If more than maxSize reads are kept, the reads with the most distant mates are spilled to disk until the position of their mates is reached.
+type MateBuffer struct {
+	header   *sam.Header
+	maxSize  int
+	ref      int
+	pos      int
+	mates    map[MateKey]*sam.Record
+	waiting  mateHeap
+	spillDir string
+	spills   []mateSpill
+	nSpill   int
+}
+
+// mateSpill is a file of spilled reads, to be loaded when the first mate position (ref, pos) is reached.
+type mateSpill struct {
+	path string
+	ref  int
+	pos  int
+}
+
+// mateHeap is a min-heap of reads waiting for their mate ordered by mate position.
+type mateHeap []*sam.Record
+
+func (h mateHeap) Len() int            { return len(h) }
+func (h mateHeap) Less(i, j int) bool  { return mateBefore(h[i], h[j].MateRef.ID(), h[j].MatePos) }
+func (h mateHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mateHeap) Push(x interface{}) { *h = append(*h, x.(*sam.Record)) }
+func (h *mateHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// mateBefore returns true if the mate of r is expected before position (ref, pos).
+func mateBefore(r *sam.Record, ref int, pos int) bool {
+	if mref := r.MateRef.ID(); mref != ref {
+		return mref < ref
+	}
+	return r.MatePos < pos
+}
+
+func NewMateBuffer(header *sam.Header, maxSize int) *MateBuffer {
+	return &MateBuffer{header: header, maxSize: maxSize, ref: -1, mates: make(map[MateKey]*sam.Record)}
+}
+
+// mateKey returns the key of read r shared with its mate.
+func mateKey(r *sam.Record) MateKey {
+	hi, ok := esam.TagInt(r, []byte{'H', 'I'})
+	if !ok {
+		hi = -1
+	}
+	if r.Flags&sam.Read2 != 0 {
+		return MateKey{Name: r.Name, HI: hi, Ref1: r.MateRef.ID(), Pos1: r.MatePos, Ref2: r.Ref.ID(), Pos2: r.Pos}
+	}
+	return MateKey{Name: r.Name, HI: hi, Ref1: r.Ref.ID(), Pos1: r.Pos, Ref2: r.MateRef.ID(), Pos2: r.MatePos}
+}
+
+// orphan returns the pair of read r without mate.
+func orphan(r *sam.Record) *Pair {
+	return &Pair{Reads: []*sam.Record{r}, OnlyRead1: r.Flags&sam.Read1 != 0}
+}
+
+// Add adds read r to the buffer. It returns the pair if the mate of r was found, r alone if its mate is unmapped or missing, and the orphans with a mate expected before r.
+func (mb *MateBuffer) Add(r *sam.Record) ([]*Pair, error) {
+	var pairs []*Pair
+	if r.Flags&sam.Unmapped != 0 || r.Flags&sam.Supplementary != 0 {
+		return pairs, nil
+	}
+	mb.ref, mb.pos = r.Ref.ID(), r.Pos
+	// Spilled reads with mates from current position
+	for len(mb.spills) > 0 && (mb.spills[0].ref < mb.ref || (mb.spills[0].ref == mb.ref && mb.spills[0].pos <= mb.pos)) {
+		if err := mb.load(mb.spills[0].path); err != nil {
+			return pairs, err
+		}
+		mb.spills = mb.spills[1:]
+	}
+	// Orphans with mate expected before r
+	pairs = append(pairs, mb.expire(mb.ref, mb.pos)...)
+	// Mate unmapped or expected before r
+	if r.Flags&sam.MateUnmapped != 0 || mateBefore(r, mb.ref, mb.pos) {
+		key := mateKey(r)
+		if m, ok := mb.mates[key]; ok {
+			delete(mb.mates, key)
+			return append(pairs, mb.pair(m, r)), nil
+		}
+		return append(pairs, orphan(r)), nil
+	}
+	// Mate found
+	key := mateKey(r)
+	if m, ok := mb.mates[key]; ok {
+		delete(mb.mates, key)
+		return append(pairs, mb.pair(m, r)), nil
+	}
+	// Wait for mate
+	mb.mates[key] = r
+	heap.Push(&mb.waiting, r)
+	if len(mb.mates) > mb.maxSize {
+		if err := mb.spill(); err != nil {
+			return pairs, err
+		}
+	}
+	return pairs, nil
+}
+
+// expire returns the reads still waiting for a mate expected before position (ref, pos) as orphans.
+func (mb *MateBuffer) expire(ref int, pos int) []*Pair {
+	var pairs []*Pair
+	for len(mb.waiting) > 0 && mateBefore(mb.waiting[0], ref, pos) {
+		m := heap.Pop(&mb.waiting).(*sam.Record)
+		key := mateKey(m)
+		// Skip reads already paired
+		if mb.mates[key] == m {
+			delete(mb.mates, key)
+			pairs = append(pairs, orphan(m))
+		}
+	}
+	return pairs
+}
+
+// pair returns the pair of mates with read 1 first.
+func (mb *MateBuffer) pair(m, r *sam.Record) *Pair {
+	if r.Flags&sam.Read1 != 0 {
+		return &Pair{Reads: []*sam.Record{r, m}}
+	}
+	return &Pair{Reads: []*sam.Record{m, r}}
+}
+
+// spill writes the reads with the most distant mates to disk, keeping half of maxSize reads (and reads with a mate at current position) in memory.
+func (mb *MateBuffer) spill() error {
+	var err error
+	if mb.spillDir == "" {
+		if mb.spillDir, err = os.MkdirTemp("", "geneabacus-mates-"); err != nil {
+			return err
+		}
+	}
+	// Waiting reads sorted by mate position
+	waiting := make([]*sam.Record, 0, len(mb.mates))
+	for _, m := range mb.mates {
+		waiting = append(waiting, m)
+	}
+	sort.Slice(waiting, func(i, j int) bool { return mateBefore(waiting[i], waiting[j].MateRef.ID(), waiting[j].MatePos) })
+	n := mb.maxSize / 2
+	for n < len(waiting) && mateBefore(waiting[n], mb.ref, mb.pos+1) {
+		n++
+	}
+	if n == len(waiting) {
+		return nil
+	}
+	// Spill
+	path := filepath.Join(mb.spillDir, strconv.Itoa(mb.nSpill)+".sam")
+	mb.nSpill++
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range waiting[n:] {
+		b, err := m.MarshalSAM(sam.FlagDecimal)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+		delete(mb.mates, mateKey(m))
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	sp := mateSpill{path: path, ref: waiting[n].MateRef.ID(), pos: waiting[n].MatePos}
+	i := sort.Search(len(mb.spills), func(i int) bool {
+		return sp.ref < mb.spills[i].ref || (sp.ref == mb.spills[i].ref && sp.pos < mb.spills[i].pos)
+	})
+	mb.spills = append(mb.spills, mateSpill{})
+	copy(mb.spills[i+1:], mb.spills[i:])
+	mb.spills[i] = sp
+	// Kept reads
+	mb.waiting = append(mb.waiting[:0], waiting[:n]...)
+	heap.Init(&mb.waiting)
+	return nil
+}
+
+// load reads back spilled reads from path.
+func (mb *MateBuffer) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		r := &sam.Record{}
+		if err = r.UnmarshalSAM(mb.header, scanner.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+		mb.mates[mateKey(r)] = r
+		heap.Push(&mb.waiting, r)
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Flush returns all reads left in the buffer (including spilled reads) as orphans.
+func (mb *MateBuffer) Flush() ([]*Pair, error) {
+	for _, sp := range mb.spills {
+		if err := mb.load(sp.path); err != nil {
+			return nil, err
+		}
+	}
+	mb.spills = nil
+	var pairs []*Pair
+	for len(mb.waiting) > 0 {
+		m := heap.Pop(&mb.waiting).(*sam.Record)
+		key := mateKey(m)
+		if mb.mates[key] == m {
+			delete(mb.mates, key)
+			pairs = append(pairs, orphan(m))
+		}
+	}
+	return pairs, nil
+}
+
+// Close removes the spilled reads.
+func (mb *MateBuffer) Close() error {
+	if mb.spillDir != "" {
+		return os.RemoveAll(mb.spillDir)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+func TestMateBuffer(t *testing.T) {
+	header := testHeader(t)
+	// Coordinate-sorted mates: p1 and p3 on chr1, p2 on chr1 and chr2, p4 with missing mate, p5 with mates at same position
+	records := testSAM(t, header,
+		"p1 65 chr1 101 255 10M = 501 0 AAAAAAAAAA *",
+		"p2 65 chr1 151 255 10M chr2 51 0 AAAAAAAAAA *",
+		"p3 65 chr1 201 255 10M = 301 0 AAAAAAAAAA *",
+		"p4 65 chr1 251 255 10M = 901 0 AAAAAAAAAA *",
+		"p3 129 chr1 301 255 10M = 201 0 AAAAAAAAAA *",
+		"p5 129 chr1 401 255 10M = 401 0 AAAAAAAAAA *",
+		"p5 65 chr1 401 255 10M = 401 0 AAAAAAAAAA *",
+		"p1 129 chr1 501 255 10M = 101 0 AAAAAAAAAA *",
+		"p2 129 chr2 51 255 10M chr1 151 0 AAAAAAAAAA *",
+	)
+	want := map[string][]int{"p1": {101, 501}, "p2": {151, 51}, "p3": {201, 301}, "p4": {251}, "p5": {401, 401}}
+	tests := []struct {
+		name      string
+		maxSize   int
+		wantSpill bool
+	}{
+		{"memory", 100, false},
+		{"spill", 2, true},
+		{"spill all", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := NewMateBuffer(header, tt.maxSize)
+			defer mb.Close()
+			var pairs []*Pair
+			for _, r := range records {
+				p, err := mb.Add(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pairs = append(pairs, p...)
+			}
+			p, err := mb.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pairs = append(pairs, p...)
+			got := make(map[string][]int)
+			for _, pair := range pairs {
+				if _, ok := got[pair.Reads[0].Name]; ok {
+					t.Errorf("got %s twice", pair.Reads[0].Name)
+				}
+				if pair.Reads[0].Flags&sam.Read1 == 0 {
+					t.Errorf("got %s without read 1 first", pair.Reads[0].Name)
+				}
+				for _, r := range pair.Reads {
+					got[r.Name] = append(got[r.Name], r.Pos+1)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if (mb.nSpill > 0) != tt.wantSpill {
+				t.Errorf("got %d spill(s), want spill %v", mb.nSpill, tt.wantSpill)
+			}
+		})
+	}
+}
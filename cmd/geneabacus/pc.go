@@ -14,8 +14,11 @@ import (
 	"io"
 	"math/rand"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
@@ -39,24 +42,39 @@ const (
 
 type Packet struct {
 	ID             uint32
+	Group          bool
 	Counts         []float64
 	ProfileChanges *profile.ProfileChange
+	Frame          int
+	FrameCount     float32
+	Region         int
+	RegionCounts   []float64
+	EMCount        float64
 }
 
 type Cache struct {
-	Packets     []Packet
-	LastPacket  int
-	InputCount  float64
-	MultiCounts []float64
+	Packets        []Packet
+	LastPacket     int
+	InputCount     float64
+	MultiCounts    []float64
+	AmbiguousCount float64
+	OffsetMetagene *profile.OffsetMetagene
+	FrameLengths   map[int]*profile.FrameCounts
+	Junctions      map[feature.Junction][]float64
+	CellUMIs       map[feature.CellUMI]bool
 }
 
 func NewCache(size int, nMulti int) *Cache {
 	c := Cache{}
 	c.MultiCounts = make([]float64, nMulti)
+	c.FrameLengths = make(map[int]*profile.FrameCounts)
+	c.Junctions = make(map[feature.Junction][]float64)
+	c.CellUMIs = make(map[feature.CellUMI]bool)
 	c.Packets = make([]Packet, size)
 	for i := 0; i < size; i++ {
 		// Count
 		c.Packets[i].Counts = make([]float64, nMulti)
+		c.Packets[i].RegionCounts = make([]float64, nMulti)
 		// Profile
 		c.Packets[i].ProfileChanges = profile.NewProfileChange(cacheProfileLength)
 	}
@@ -70,14 +88,89 @@ func (c *Cache) Grow() {
 	for i := osize; i < nsize; i++ {
 		// Count
 		c.Packets[i].Counts = make([]float64, len(c.Packets[0].Counts))
+		c.Packets[i].RegionCounts = make([]float64, len(c.Packets[0].Counts))
 		// Profile
 		c.Packets[i].ProfileChanges = profile.NewProfileChange(cacheProfileLength)
 	}
 }
 
 type Pair struct {
-	Reads     []*sam.Record
-	OnlyRead1 bool
+	Reads           []*sam.Record
+	OnlyRead1       bool
+	Multi           int
+	Resolved        bool
+	Overlap         map[uint32]feature.FeatureOverlap
+	OverlapFraction float32
+	TwinFraction    float32
+	Intronic        bool
+	Ambiguous       bool
+	Duplicates      []uint32
+}
+
+// IsDuplicate returns true if pair is a duplicate within feature featID (see UMIDedup).
+func (p *Pair) IsDuplicate(featID uint32) bool {
+	for _, d := range p.Duplicates {
+		if d == featID {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve sets the features overlapped by pair after overlap resolution and minimum overlap filtering. Features on opposite strand (featID >= nCount) are resolved apart.
+func (p *Pair) Resolve(trees map[string]map[int8]*interval.IntTree, nCount uint32, opt *PConOptions) {
+	featuresOverlap := feature.OverlapFeatureRead(p.Reads, opt.LibraryR1Strand, trees, opt.OverlapJunction)
+	// Features on opposite strand (only used for profiles)
+	var twinsOverlap map[uint32]feature.FeatureOverlap
+	if opt.ProfileStranded {
+		twinsOverlap = make(map[uint32]feature.FeatureOverlap)
+		for featID, overlap := range featuresOverlap {
+			if featID >= nCount {
+				if !opt.CountIntron || overlap.Length > 0 {
+					twinsOverlap[featID] = overlap
+				}
+				delete(featuresOverlap, featID)
+			}
+		}
+	}
+	// Read(s) only overlapping intron(s) are intronic and assigned using their intron overlap. Otherwise, features only overlapped in intron(s) are ignored.
+	p.Intronic = false
+	if opt.CountIntron {
+		p.Intronic = len(featuresOverlap) > 0
+		for _, overlap := range featuresOverlap {
+			if overlap.Length > 0 {
+				p.Intronic = false
+				break
+			}
+		}
+		for featID, overlap := range featuresOverlap {
+			if p.Intronic {
+				overlap.Length = overlap.IntronLength
+				featuresOverlap[featID] = overlap
+			} else if overlap.Length == 0 {
+				delete(featuresOverlap, featID)
+			}
+		}
+	}
+	// Select features for reads overlapping several features
+	featuresOverlap, p.OverlapFraction, p.Ambiguous = feature.ResolveOverlap(p.Reads, opt.LibraryR1Strand, trees, featuresOverlap, p.Intronic, opt.OverlapMode, opt.MinOverlap)
+	if len(twinsOverlap) > 0 {
+		twinsOverlap, p.TwinFraction, _ = feature.ResolveOverlap(p.Reads, opt.LibraryR1Strand, trees, twinsOverlap, false, opt.OverlapMode, opt.MinOverlap)
+		if featuresOverlap == nil {
+			featuresOverlap = make(map[uint32]feature.FeatureOverlap)
+		}
+		for featID, overlap := range twinsOverlap {
+			featuresOverlap[featID] = overlap
+		}
+	}
+	// Minimum overlap
+	for featID, overlap := range featuresOverlap {
+		if overlap.Length < opt.MinOverlap {
+			delete(featuresOverlap, featID)
+		}
+	}
+	p.Overlap = featuresOverlap
+	p.Resolved = true
 }
 
 // AddCommas adds commas after every 3 characters.
@@ -103,120 +196,317 @@ func Abs(n int) int {
 	return n
 }
 
-func OpenSAM(pathSAM esam.PathSAM, cmd []string, nWorker1 int) (f *os.File, pp io.ReadCloser, rr sam.RecordReader, err error) {
+// SuffixPath inserts suffix (strand or channel) before the extension of path (profiles.bedgraph to profiles.plus.bedgraph).
+func SuffixPath(path string, suffix string) string {
+	if suffix == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ext
+}
+
+func OpenSAM(pathSAM esam.PathSAM, cmd []string, nWorker1 int) (in *SAMInput, rr sam.RecordReader, err error) {
 	if pathSAM.Binary {
-		f, err = os.Open(pathSAM.Path)
+		f, err := os.Open(pathSAM.Path)
 		if err != nil {
-			return f, pp, rr, err
+			return in, rr, err
 		}
+		in = &SAMInput{Reader: f, f: f}
 		rr, err = bam.NewReader(f, nWorker1)
+		if err != nil {
+			in.Close()
+			return in, rr, err
+		}
 	} else {
-		if len(cmd) == 0 {
-			f, err = os.Open(pathSAM.Path)
-			if err != nil {
-				return f, pp, rr, err
-			}
-			rr, err = sam.NewReader(f)
-		} else {
-			cmd = append(cmd, pathSAM.Path)
-			p := exec.Command(cmd[0], cmd[1:]...)
-			if pp, err = p.StdoutPipe(); err != nil {
-				return f, pp, rr, err
-			}
-			if err = p.Start(); err != nil {
-				return f, pp, rr, err
+		in, err = OpenSAMInput(pathSAM.Path, cmd)
+		if err != nil {
+			return in, rr, err
+		}
+		rr, err = sam.NewReader(in)
+		if err != nil {
+			// Report command failure first
+			if e := in.Close(); e != nil {
+				err = e
 			}
-			rr, err = sam.NewReader(pp)
+			return in, rr, err
 		}
 	}
-	return f, pp, rr, nil
+	return in, rr, nil
 }
 
 func GetSAMHeader(pathSAM esam.PathSAM, cmd []string) (*sam.Header, error) {
-	var err error
-	f, err := os.Open(pathSAM.Path)
+	in, rr, err := OpenSAM(pathSAM, cmd, 1)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	if pathSAM.Binary {
-		rr, err := bam.NewReader(f, 1)
-		if err != nil {
-			return nil, err
-		}
-		return rr.Header(), nil
-	} else {
-		if len(cmd) == 0 {
-			f, err := os.Open(pathSAM.Path)
-			if err != nil {
-				return nil, err
-			}
-			rr, err := sam.NewReader(f)
-			return rr.Header(), nil
-		} else {
-			var pp io.ReadCloser
-			var err error
-			cmd = append(cmd, pathSAM.Path)
-			p := exec.Command(cmd[0], cmd[1:]...)
-			if pp, err = p.StdoutPipe(); err != nil {
-				return nil, err
-			}
-			defer pp.Close()
-			if err := p.Start(); err != nil {
-				return nil, err
-			}
-			rr, err := sam.NewReader(pp)
-			return rr.Header(), nil
-		}
+	defer in.Close()
+	if hr, ok := rr.(interface{ Header() *sam.Header }); ok {
+		return hr.Header(), nil
 	}
-	return nil, nil
+	return nil, fmt.Errorf("Missing header in %s", pathSAM.Path)
+}
+
+// PConOptions holds the options of PConFeature.
+type PConOptions struct {
+	// Alignment selection
+	ReadLengths       []int
+	FragmentMinLength int
+	FragmentMaxLength int
+	RandProportion    float32
+	Paired            bool
+	LibraryR1Strand   int8
+	IgnoreNHTag       bool
+	AlignmentSelect   int
+	MateBufferSize    int
+	UseBAMIndex       bool
+	InProperPair      bool
+	MinMappingQuality byte
+	MinOverlap        int
+	OverlapMode       int
+	OverlapJunction   bool
+	// Counts
+	CountMultis        []int
+	CountUnits         []int
+	CountTotals        []float64
+	CountTotalInput    bool
+	CountTotalRealRead bool
+	CountInProfile     bool
+	CountIntron        bool
+	CountPath          string
+	CountGroupPath     string
+	JunctionPath       string
+	// Single-cell counts
+	CellPath       string
+	CellBarcodeTag string
+	CellUMITag     string
+	CellBarcodes   map[string]bool
+	CellMulti      int
+	UMISource      string
+	// Profiles
+	ProfileType             int
+	ProfileMulti            int
+	ProfileOverhang         int
+	ProfileNoCoordMapping   bool
+	ProfileStranded         bool
+	ProfileMinusNegative    bool
+	ProfileUntemplated      int
+	ProfileNoUntemplated    bool
+	ProfileOffsets          *profile.Offsets
+	ProfileExtensionLength  int
+	ProfilePositionFraction float64
+	ProfileRTShift          int
+	ProfileNorm             bool
+	ProfileMultiTotalCol    int
+	ProfilePaths            []string
+	ProfileFormats          []string
+	// Offsets, frames & metagenes
+	OffsetEstimatePath string
+	OffsetMetagenePath string
+	OffsetWindow       int
+	FramePath          string
+	FrameLengthPath    string
+	MetagenePath       string
+	MetageneLandmarks  []int
+	MetageneWindow     int
+	MetageneNorm       bool
+	MetageneMean       bool
+	// Output
+	AppendOutput bool
+	PathReport   string
+	PathSAMOut   esam.PathSAM
+	NWorker      int
+	VerboseLevel int
 }
 
-func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.Feature, featuresMapping map[string]string, trees map[string]map[int8]*interval.IntTree, readLengths []int, fragmentMinLength int, fragmentMaxLength int, randProportion float32, paired bool, libraryR1Strand int8, ignoreNHTag bool, inProperPair bool, minMappingQuality byte, minOverlap int, countMultis []int, countTotals []float64, countTotalInput bool, countTotalRealRead bool, countInProfile bool, countPath string, profileType int, profileMulti int, profileOverhang int, profileNoCoordMapping bool, profileUntemplated int, profileNoUntemplated bool, profileExtensionLength int, profilePositionFraction float64, profileNorm bool, profileMultiTotalCol int, profilePaths []string, profileFormats []string, appendOutput bool, pathReport string, pathSAMOut esam.PathSAM, nWorker int, timeStart time.Time, verboseLevel int) (nAlign uint64, err error) {
+func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.Feature, featuresMapping map[string]string, trees map[string]map[int8]*interval.IntTree, multiEM *MultiEM, opt PConOptions, timeStart time.Time) (nAlign uint64, err error) {
 	// Compute profile(s) ?
 	var doProfile bool
-	if profileType != profile.ProfileTypeNone {
+	if opt.ProfileType != profile.ProfileTypeNone {
 		doProfile = true
 	}
+	// Frame counts
+	var frameFeatures []profile.FrameCounts
+	frameLengths := make(map[int]*profile.FrameCounts)
+	if opt.ProfileType == profile.ProfileTypeFrame {
+		frameFeatures = make([]profile.FrameCounts, len(features))
+	}
+	// Junction counts
+	var doJunction bool
+	var junctionCounts map[feature.Junction][]float64
+	if opt.JunctionPath != "" {
+		doJunction = true
+		junctionCounts = make(map[feature.Junction][]float64)
+	}
+	// Cell counts
+	var doCell bool
+	var cellUMIs map[feature.CellUMI]bool
+	if opt.CellPath != "" {
+		doCell = true
+		cellUMIs = make(map[feature.CellUMI]bool)
+	}
+	// UMI deduplication
+	var doDedup bool
+	var dedup *UMIDedup
+	var dedupCounts []uint32
+	var umiMissing uint32
+	if opt.UMISource != "" {
+		doDedup = true
+		dedup = NewUMIDedup(opt.UMISource)
+		dedupCounts = make([]uint32, len(features))
+	}
+	// Read(s) filtering (before UMI deduplication and in worker(s))
+	pairSelected := func(pair *Pair) bool {
+		// Read length (both mates have to be desired length)
+		if len(opt.ReadLengths) > 0 {
+			apairLengthOK := true
+			for _, aread := range pair.Reads {
+				areadLengthOK := false
+				for _, l := range opt.ReadLengths {
+					if l == aread.Seq.Length {
+						areadLengthOK = true
+					}
+				}
+				if areadLengthOK == false {
+					apairLengthOK = false
+					break
+				}
+			}
+			if apairLengthOK == false {
+				return false
+			}
+		}
+
+		// Proper pair and mapping quality
+		if opt.InProperPair || opt.MinMappingQuality > 0 {
+			filterOK := true
+			for _, aread := range pair.Reads {
+				// Is read in proper pair
+				if opt.InProperPair {
+					if aread.Flags&sam.ProperPair == 0 {
+						filterOK = false
+						break
+					}
+				}
+				// Minimum read mapping quality
+				if opt.MinMappingQuality > 0 {
+					if aread.MapQ < opt.MinMappingQuality {
+						filterOK = false
+						break
+					}
+				}
+			}
+			if filterOK == false {
+				return false
+			}
+		}
+
+		// Fragment length filtering
+		if opt.ProfileNoCoordMapping && (opt.FragmentMinLength > 0 || opt.FragmentMaxLength > 0) {
+			fragmentLength := Abs(pair.Reads[0].TempLen)
+			if opt.FragmentMinLength > 0 && fragmentLength < opt.FragmentMinLength {
+				return false
+			}
+			if opt.FragmentMaxLength > 0 && fragmentLength > opt.FragmentMaxLength {
+				return false
+			}
+		}
+		return true
+	}
+	// Multi-mapping reads redistributed by EM: additional count column
+	var doEM, doEMCollect bool
+	var emMulti int
+	countCols := opt.CountMultis
+	if multiEM != nil {
+		if multiEM.Collect {
+			doEMCollect = true
+		} else {
+			doEM = true
+			for _, cm := range opt.CountMultis {
+				emMulti = Max(emMulti, cm)
+			}
+			countCols = append(append([]int{}, opt.CountMultis...), feature.CountMultiEM)
+			opt.CountTotals = append(opt.CountTotals, make([]float64, 1+len(opt.CountUnits))...)
+		}
+	}
+	// Estimate offsets ?
+	var doOffset bool
+	var offsetMetagene *profile.OffsetMetagene
+	if opt.OffsetEstimatePath != "" || opt.OffsetMetagenePath != "" {
+		doOffset = true
+		offsetMetagene = profile.NewOffsetMetagene(opt.OffsetWindow)
+	}
+	// Offsets per read length
+	var profileOffsetsFive, profileOffsetsThree map[int]int
+	if opt.ProfileOffsets != nil {
+		profileOffsetsFive = opt.ProfileOffsets.Five
+		profileOffsetsThree = opt.ProfileOffsets.Three
+	}
 	// Workers
-	nWorker1 := Max(1, int(nWorker/2.))
-	nWorker2 := Max(1, nWorker-nWorker1)
+	nWorker1 := Max(1, int(opt.NWorker/2.))
+	nWorker2 := Max(1, opt.NWorker-nWorker1)
+
+	// Profile channel(s)
+	channelNames := profile.ProfileChannelNames[opt.ProfileType]
+	nChannel := Max(1, len(channelNames))
 
 	// Init. extended features
 	var featureExts []*feature.FeatureExt
-	featureExts, err = feature.ExtendFeatures(features, countMultis, doProfile, profileOverhang)
+	featureExts, err = feature.ExtendFeatures(features, countCols, opt.CountUnits, doProfile, doOffset, opt.ProfileOverhang, nChannel)
 	if err != nil {
 		return nAlign, err
 	}
 
+	// Counted features (with stranded profiles, features on the opposite strand are only used for profiles)
+	countExts := featureExts
+	if opt.ProfileStranded {
+		countExts = featureExts[:len(featureExts)/2]
+	}
+	nCount := uint32(len(countExts))
+
+	// Init. region counts
+	if opt.CountIntron {
+		for _, feat := range featureExts {
+			feat.RegionCounts = make([]float64, len(opt.CountMultis)*len(feature.RegionNames))
+		}
+	}
+
+	// Init. feature groups
+	var doGroup bool
+	var groupExts []*feature.FeatureExt
+	var groupIDs []uint32
+	if opt.CountGroupPath != "" {
+		doGroup = true
+		groupExts, groupIDs = feature.GroupFeatures(countExts, opt.CountMultis, opt.CountUnits)
+	}
+
 	// Init. input counter
 	var inputCount float64
 
 	// Init. read or multiplicity counter
 	var multiSets []set.Interface
 	var multisCounts []float64
-	if countTotalRealRead {
-		if verboseLevel > 0 {
+	if opt.CountTotalRealRead {
+		if opt.VerboseLevel > 0 {
 			timeNow := time.Now()
 			fmt.Printf("%.1fmin - Init. total full-read counter\n", timeNow.Sub(timeStart).Minutes())
 		}
-		for icm := 0; icm < len(countMultis); icm++ {
+		for icm := 0; icm < len(opt.CountMultis); icm++ {
 			multiSets = append(multiSets, set.New(set.ThreadSafe))
 		}
 	} else {
-		if verboseLevel > 0 {
+		if opt.VerboseLevel > 0 {
 			timeNow := time.Now()
 			fmt.Printf("%.1fmin - Init. total proportion-read counter\n", timeNow.Sub(timeStart).Minutes())
 		}
-		multisCounts = make([]float64, len(countMultis))
+		multisCounts = make([]float64, len(opt.CountMultis))
 	}
 
 	// Open output SAM
 	var doOutSAM bool
 	var samWriter *sam.Writer
-	if pathSAMOut.Path != "" {
+	if opt.PathSAMOut.Path != "" {
 		// Open output file
-		f, err := os.Create(pathSAMOut.Path)
+		f, err := os.Create(opt.PathSAMOut.Path)
 		if err != nil {
 			return nAlign, err
 		}
@@ -235,38 +525,137 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 	}
 
 	// Init context
-	ctx, _ := context.WithCancel(context.Background()) // cancelFunc not used
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	// Start sync errgroup
 	g, gctx := errgroup.WithContext(ctx)
 
 	// Start receiving channel
-	chFinal := make(chan *Cache, nWorker*10)
+	chFinal := make(chan *Cache, opt.NWorker*10)
 	// Start alignment channel
-	chAln := make(chan []*Pair, nWorker*10)
+	chAln := make(chan []*Pair, opt.NWorker*10)
+
+	// Regions covered by features to read using BAM index
+	var bamRegions map[string][][]int
+	if opt.UseBAMIndex {
+		bamRegions = feature.TreeRegions(trees)
+	}
 
 	//go func() {
 	g.Go(func() error {
 		defer close(chAln)
 		timeLog := time.Now()
 		for _, pathSAM := range pathSAMs {
-			var f *os.File
-			var pp io.ReadCloser
+			var in *SAMInput
 			var rr sam.RecordReader
 			var err error
 			var iPair int
 			sPair := make([]*Pair, sPairLength)
-			if verboseLevel > 0 {
+			if opt.VerboseLevel > 0 {
 				timeNow := time.Now()
 				fmt.Printf("%.1fmin - Opening %s\n", timeNow.Sub(timeStart).Minutes(), pathSAM.Path)
 			}
 			// Open SAM
-			f, pp, rr, err = OpenSAM(pathSAM, SAMCmdIn, nWorker1)
+			in, rr, err = OpenSAM(pathSAM, SAMCmdIn, nWorker1)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-			if pp != nil {
-				defer pp.Close()
+			defer in.Close()
+			// Best alignment selection requires all alignments of a read to be consecutive
+			if opt.AlignmentSelect == AlignmentSelectBest {
+				if hr, ok := rr.(interface{ Header() *sam.Header }); ok && hr.Header().SortOrder == sam.Coordinate {
+					return fmt.Errorf("Best alignment selection requires alignments grouped by read name (%s is coordinate-sorted)", pathSAM.Path)
+				}
+			}
+			// UMIs of single-end coordinate-sorted input are kept in memory until reads pass their position
+			if doDedup {
+				hr, ok := rr.(interface{ Header() *sam.Header })
+				dedup.Sorted = ok && !opt.Paired && len(pathSAMs) == 1 && hr.Header().SortOrder == sam.Coordinate
+			}
+			// Only read chunks overlapping features using BAM index (single-end coordinate-sorted BAM)
+			if opt.UseBAMIndex {
+				indexPath := FindBAMIndex(pathSAM.Path)
+				br, isBAM := rr.(*bam.Reader)
+				if isBAM && !opt.Paired && indexPath != "" && br.Header().SortOrder == sam.Coordinate {
+					chunks, err := BAMIndexChunks(indexPath, br.Header(), bamRegions)
+					if err != nil {
+						return err
+					}
+					if opt.VerboseLevel > 0 {
+						timeNow := time.Now()
+						fmt.Printf("%.1fmin - Reading %d chunk(s) of %s using %s\n", timeNow.Sub(timeStart).Minutes(), len(chunks), pathSAM.Path, indexPath)
+					}
+					if rr, err = NewRegionReader(br, chunks); err != nil {
+						return err
+					}
+				} else if opt.VerboseLevel > 0 {
+					timeNow := time.Now()
+					fmt.Printf("%.1fmin - Full scan of %s (BAM index requires single-end coordinate-sorted BAM with index)\n", timeNow.Sub(timeStart).Minutes(), pathSAM.Path)
+				}
+			}
+
+			// Send pair to worker(s)
+			sendPair := func(pair *Pair) error {
+				// UMI deduplication per feature: first read(s) in input order are kept
+				if doDedup && pairSelected(pair) {
+					pair.Resolve(trees, nCount, &opt)
+					if !dedup.Mark(pair, pair.Overlap) {
+						umiMissing++
+					}
+				}
+				sPair[iPair] = pair
+				if iPair == sPairLength-1 {
+					select {
+					case <-gctx.Done():
+						return gctx.Err()
+					case chAln <- sPair:
+					}
+					sPair = make([]*Pair, sPairLength)
+					iPair = -1
+				}
+				iPair++
+				nAlign++
+
+				if opt.VerboseLevel > 0 {
+					timeNow := time.Now()
+					if timeNow.Sub(timeLog).Minutes() > 1. {
+						fmt.Printf("%.1fmin - %s align. - %.2f Ma/hr\n", timeNow.Sub(timeStart).Minutes(), AddCommas(strconv.FormatUint(nAlign, 10)), (float64(nAlign)/timeNow.Sub(timeStart).Hours())/1000000.)
+						timeLog = timeNow
+					}
+				}
+				return nil
+			}
+			// Send selected alignment(s)
+			sendPairs := func(pairs []*Pair) error {
+				pairs, err := SelectPairs(pairs, opt.AlignmentSelect)
+				if err != nil {
+					return err
+				}
+				for _, pair := range pairs {
+					if err := sendPair(pair); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			// Send alignment(s) of one read
+			var group []*sam.Record
+			sendGroup := func() error {
+				err := sendPairs(GroupPairs(group, opt.Paired))
+				group = group[:0]
+				return err
+			}
+			// Mates of coordinate-sorted paired-end reads
+			var mateBuffer *MateBuffer
+			if opt.Paired {
+				if hr, ok := rr.(interface{ Header() *sam.Header }); ok && hr.Header().SortOrder == sam.Coordinate {
+					if opt.VerboseLevel > 0 {
+						timeNow := time.Now()
+						fmt.Printf("%.1fmin - Pairing mates of coordinate-sorted %s\n", timeNow.Sub(timeStart).Minutes(), pathSAM.Path)
+					}
+					mateBuffer = NewMateBuffer(hr.Header(), opt.MateBufferSize)
+					defer mateBuffer.Close()
+				}
 			}
 
 			// Loop over reads
@@ -281,9 +670,30 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 				} else if err != nil {
 					return err
 				}
+				// Mates paired from buffer
+				if mateBuffer != nil {
+					pairs, err := mateBuffer.Add(aread)
+					if err != nil {
+						return err
+					}
+					if err = sendPairs(pairs); err != nil {
+						return err
+					}
+					continue
+				}
+				// Alignments grouped by read name
+				if opt.AlignmentSelect != AlignmentSelectAll {
+					if len(group) > 0 && aread.Name != group[0].Name {
+						if err = sendGroup(); err != nil {
+							return err
+						}
+					}
+					group = append(group, aread)
+					continue
+				}
 				read1Mapped = aread.Flags&sam.Unmapped == 0
 				// Get mate
-				if paired {
+				if opt.Paired {
 					mateMapped = aread.Flags&sam.MateUnmapped == 0
 					if mateMapped {
 						for {
@@ -330,25 +740,26 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 					}
 					pair.Reads = append(pair.Reads, aread)
 				}
-				sPair[iPair] = &pair
-				if iPair == sPairLength-1 {
-					select {
-					case <-gctx.Done():
-						return gctx.Err()
-					case chAln <- sPair:
-					}
-					sPair = make([]*Pair, sPairLength)
-					iPair = -1
+				if err = sendPair(&pair); err != nil {
+					return err
 				}
-				iPair++
-				nAlign++
-
-				if verboseLevel > 0 {
-					timeNow := time.Now()
-					if timeNow.Sub(timeLog).Minutes() > 1. {
-						fmt.Printf("%.1fmin - %s align. - %.2f Ma/hr\n", timeNow.Sub(timeStart).Minutes(), AddCommas(strconv.FormatUint(nAlign, 10)), (float64(nAlign)/timeNow.Sub(timeStart).Hours())/1000000.)
-						timeLog = timeNow
-					}
+			}
+			// Check decompression or command exit status
+			if err = in.Close(); err != nil {
+				return err
+			}
+			if len(group) > 0 {
+				if err = sendGroup(); err != nil {
+					return err
+				}
+			}
+			if mateBuffer != nil {
+				pairs, err := mateBuffer.Flush()
+				if err != nil {
+					return err
+				}
+				if err = sendPairs(pairs); err != nil {
+					return err
 				}
 			}
 			// Send last packet
@@ -367,7 +778,10 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 	// Init cache pool
 	pool := make(chan *Cache, nWorker2*2)
 	for i := 0; i < cap(pool); i++ {
-		c := NewCache(cacheLength, len(countMultis))
+		c := NewCache(cacheLength, len(opt.CountMultis))
+		if doOffset {
+			c.OffsetMetagene = profile.NewOffsetMetagene(opt.OffsetWindow)
+		}
 		pool <- c
 	}
 
@@ -382,6 +796,13 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 				var apairKeep, coordProfileInside bool
 				var pairCount float32
 				var pairMulti int
+				var pairFraction, emFraction float64
+				var pairGroups []uint32
+				var pairGroupCounts []float64
+				var pairJunctions [][2]int
+				var pairIntronic bool
+				var pairBarcode, pairUMI string
+				var pairCell bool
 				// Loop over data
 				for sPair := range chAln {
 					// Get cache
@@ -389,9 +810,13 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 					for _, pair := range sPair {
 						// Default to not keeping pair
 						apairKeep = false
+						pairGroups = pairGroups[:0]
+						pairGroupCounts = pairGroupCounts[:0]
 
 						// Alignment multiplicity
-						if ignoreNHTag {
+						if pair.Multi > 0 {
+							pairMulti = pair.Multi
+						} else if opt.IgnoreNHTag {
 							pairMulti = 1
 						} else {
 							tag, found := pair.Reads[0].Tag([]byte{'N', 'H'})
@@ -411,158 +836,276 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 						// Input
 						c.InputCount += 1. / float64(pairMulti)
 
-						// Read length (both mates have to be desired length)
-						if len(readLengths) > 0 {
-							apairLengthOK := true
-							for _, aread = range pair.Reads {
-								areadLengthOK := false
-								for _, l := range readLengths {
-									if l == aread.Seq.Length {
-										areadLengthOK = true
-									}
-								}
-								if areadLengthOK == false {
-									apairLengthOK = false
-									break
-								}
-							}
-							if apairLengthOK == false {
+						// Read(s) filtering
+						if !pairSelected(pair) {
+							continue
+						}
+
+						// Read random selection
+						if opt.RandProportion > 0. {
+							if rand.Float32() > opt.RandProportion {
 								continue
 							}
 						}
 
-						// Read(s) filtering
-						if inProperPair || minMappingQuality > 0 {
-							filterOK := true
-							for _, aread = range pair.Reads {
-								// Is read in proper pair
-								if inProperPair {
-									if aread.Flags&sam.ProperPair == 0 {
-										filterOK = false
-										break
-									}
+						// Cell barcode and UMI
+						if doCell {
+							var okBarcode, okUMI bool
+							pairBarcode, okBarcode = esam.TagString(pair.Reads[0], []byte(opt.CellBarcodeTag))
+							pairUMI, okUMI = esam.TagString(pair.Reads[0], []byte(opt.CellUMITag))
+							pairCell = okBarcode && okUMI && pairMulti <= opt.CellMulti && (opt.CellBarcodes == nil || opt.CellBarcodes[pairBarcode])
+						}
+
+						// Get features overlap with reads (already resolved for UMI deduplication)
+						if !pair.Resolved {
+							pair.Resolve(trees, nCount, &opt)
+						}
+						if pair.Ambiguous {
+							c.AmbiguousCount += 1. / float64(pairMulti)
+						}
+						pairIntronic = pair.Intronic
+						overlapFraction, twinFraction := pair.OverlapFraction, pair.TwinFraction
+
+						// Add reads to count and profile
+						for featID, overlap := range pair.Overlap {
+							//if Debug {
+							//	for i := 0; i < len(pair.Reads); i++ {
+							//		alnRef, alnRead, alnSymbol := align.GetAln(pair.Reads[i])
+							//		fmt.Println(string(alnRef))
+							//		fmt.Println(string(alnSymbol))
+							//		fmt.Println(string(alnRead), "\n")
+							//	}
+							//}
+							// Feature
+							feat := featureExts[featID]
+							isTwin := featID >= nCount
+							featFraction := overlapFraction
+							if isTwin {
+								featFraction = twinFraction
+							}
+							pairFraction = float64(featFraction) / float64(pairMulti)
+							pairCount = featFraction / float32(pairMulti)
+
+							// Fragment length filtering
+							if !pairIntronic && !opt.ProfileNoCoordMapping && (opt.FragmentMinLength > 0 || opt.FragmentMaxLength > 0) {
+								startProfile, endProfile := profile.FragmentCoords(pair.Reads, overlap, feat, opt.ProfileNoCoordMapping)
+								fragmentLength := endProfile - startProfile
+								if opt.FragmentMinLength > 0 && fragmentLength < opt.FragmentMinLength {
+									continue
 								}
-								// Minimum read mapping quality
-								if minMappingQuality > 0 {
-									if aread.MapQ < minMappingQuality {
-										filterOK = false
-										break
-									}
+								if opt.FragmentMaxLength > 0 && fragmentLength > opt.FragmentMaxLength {
+									continue
 								}
 							}
-							if filterOK == false {
+
+							// UMI deduplication (duplicates are reported by the counting pass)
+							if pair.IsDuplicate(featID) {
+								if !doEMCollect {
+									atomic.AddUint32(&dedupCounts[feat.ID], 1)
+								}
 								continue
 							}
-						}
 
-						// Fragment length filtering
-						if profileNoCoordMapping && (fragmentMinLength > 0 || fragmentMaxLength > 0) {
-							fragmentLength := Abs(pair.Reads[0].TempLen)
-							if fragmentMinLength > 0 && fragmentLength < fragmentMinLength {
+							// Multi-mapping reads for EM
+							if doEMCollect {
+								if !isTwin && !pairIntronic {
+									multiEM.Add(pair.Reads[0].Name, pairMulti, featID, overlapFraction)
+								}
 								continue
 							}
-							if fragmentMaxLength > 0 && fragmentLength > fragmentMaxLength {
-								continue
+							if doEM && !isTwin && !pairIntronic {
+								emFraction = multiEM.Weight(pair.Reads[0].Name, pairMulti, featID, overlapFraction)
+								pairCount = float32(emFraction)
 							}
-						}
 
-						// Read random selection
-						if randProportion > 0. {
-							if rand.Float32() > randProportion {
-								continue
+							// Increase cache size
+							if len(c.Packets) <= c.LastPacket {
+								c.Grow()
 							}
-						}
+							// Current feature
+							c.Packets[c.LastPacket].ID = feat.ID
+							c.Packets[c.LastPacket].Group = false
+							c.Packets[c.LastPacket].Frame = -1
+							c.Packets[c.LastPacket].Region = -1
 
-						// Get features overlap with reads
-						featuresOverlap := feature.OverlapFeatureRead(pair.Reads, libraryR1Strand, trees)
+							// Intronic count (intronic read(s) are only counted by region)
+							if pairIntronic && !isTwin {
+								c.Packets[c.LastPacket].Region = feature.RegionIntronic
+								for icm, cm := range opt.CountMultis {
+									if pairMulti <= cm {
+										apairKeep = true
+										c.Packets[c.LastPacket].RegionCounts[icm] += pairFraction
+									}
+								}
+								c.LastPacket++
+								continue
+							}
 
-						// Add reads to count and profile
-						for featID, overlap := range featuresOverlap {
-							if overlap.Length >= minOverlap {
-								//if Debug {
-								//	for i := 0; i < len(pair.Reads); i++ {
-								//		alnRef, alnRead, alnSymbol := align.GetAln(pair.Reads[i])
-								//		fmt.Println(string(alnRef))
-								//		fmt.Println(string(alnSymbol))
-								//		fmt.Println(string(alnRead), "\n")
-								//	}
-								//}
-								// Feature
-								feat := featureExts[featID]
-
-								// Fragment length filtering
-								if !profileNoCoordMapping && (fragmentMinLength > 0 || fragmentMaxLength > 0) {
-									startProfile, endProfile := profile.FragmentCoords(pair.Reads, overlap, feat, profileNoCoordMapping)
-									fragmentLength := endProfile - startProfile
-									if fragmentMinLength > 0 && fragmentLength < fragmentMinLength {
-										continue
+							// Profile
+							if doProfile {
+								coordProfileInside = false
+								// Get read position within profile
+								if pairMulti <= opt.ProfileMulti {
+									var err error
+									switch opt.ProfileType {
+									case profile.ProfileTypeFirst:
+										coordProfileInside, err = profile.ProfileFirst(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, opt.ProfileUntemplated, opt.ProfileNoUntemplated, profileOffsetsFive)
+									case profile.ProfileTypeFrame:
+										var frame, readLength int
+										coordProfileInside, frame, readLength, err = profile.ProfileFrame(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, opt.ProfileUntemplated, opt.ProfileNoUntemplated, profileOffsetsFive)
+										if frame != -1 {
+											c.Packets[c.LastPacket].Frame = frame
+											c.Packets[c.LastPacket].FrameCount = pairCount
+											// Frame per read length only for counted features
+											if !isTwin {
+												fl, ok := c.FrameLengths[readLength]
+												if !ok {
+													fl = &profile.FrameCounts{}
+													c.FrameLengths[readLength] = fl
+												}
+												fl[frame] += float64(pairCount)
+											}
+										}
+									case profile.ProfileTypeMismatch:
+										coordProfileInside, err = profile.ProfileMismatch(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeBase:
+										coordProfileInside, err = profile.ProfileBase(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeInsertion:
+										coordProfileInside = profile.ProfileInsertion(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeDeletion:
+										coordProfileInside = profile.ProfileDeletion(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeRTStop:
+										coordProfileInside = profile.ProfileRTStop(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, opt.ProfileRTShift)
+									case profile.ProfileTypeLast:
+										coordProfileInside = profile.ProfileLast(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, profileOffsetsThree)
+									case profile.ProfileTypeFirstLast:
+										coordProfileInside = profile.ProfileFirstLast(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypePosition:
+										coordProfileInside = profile.ProfilePosition(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, opt.ProfilePositionFraction)
+									case profile.ProfileTypeAll:
+										coordProfileInside = profile.ProfileAll(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeSplice:
+										coordProfileInside = profile.ProfileSplice(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping)
+									case profile.ProfileTypeExtension:
+										coordProfileInside = profile.ProfileExtension(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, opt.ProfileNoCoordMapping, opt.ProfileExtensionLength)
 									}
-									if fragmentMaxLength > 0 && fragmentLength > fragmentMaxLength {
-										continue
+									if err != nil {
+										return err
 									}
 								}
+								// Add read to profile
+								if coordProfileInside && !isTwin {
+									apairKeep = true
+								}
+							}
 
-								// Increase cache size
-								if len(c.Packets) <= c.LastPacket {
-									c.Grow()
+							// Offset metagene
+							if doOffset && pairMulti <= opt.ProfileMulti && !isTwin {
+								c.OffsetMetagene.Add(pair.Reads, pair.OnlyRead1, opt.Paired, opt.LibraryR1Strand, overlap, feat, pairCount)
+							}
+
+							// Count
+							if !isTwin && (opt.CountInProfile == false || coordProfileInside) {
+								for icm, cm := range opt.CountMultis {
+									if pairMulti <= cm {
+										apairKeep = true
+										c.Packets[c.LastPacket].Counts[icm] += pairFraction
+									}
+								}
+								if doEM && pairMulti <= emMulti {
+									apairKeep = true
+									c.Packets[c.LastPacket].EMCount += emFraction
 								}
-								// Current feature
-								c.Packets[c.LastPacket].ID = feat.ID
-
-								// Profile
-								if doProfile {
-									coordProfileInside = false
-									// Get read position within profile
-									if pairMulti <= profileMulti {
-										var err error
-										switch profileType {
-										case profile.ProfileTypeFirst:
-											coordProfileInside, err = profile.ProfileFirst(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping, profileUntemplated, profileNoUntemplated)
-										case profile.ProfileTypeLast:
-											coordProfileInside = profile.ProfileLast(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping)
-										case profile.ProfileTypeFirstLast:
-											coordProfileInside = profile.ProfileFirstLast(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping)
-										case profile.ProfileTypePosition:
-											coordProfileInside = profile.ProfilePosition(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping, profilePositionFraction)
-										case profile.ProfileTypeAll:
-											coordProfileInside = profile.ProfileAll(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping)
-										case profile.ProfileTypeSplice:
-											coordProfileInside = profile.ProfileSplice(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping)
-										case profile.ProfileTypeExtension:
-											coordProfileInside = profile.ProfileExtension(pair.Reads, pair.OnlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, c.Packets[c.LastPacket].ProfileChanges, profileNoCoordMapping, profileExtensionLength)
+								// UMI of cell
+								if pairCell {
+									c.CellUMIs[feature.CellUMI{ID: feat.ID, Barcode: pairBarcode, UMI: pairUMI}] = true
+								}
+								// Region of feature
+								if opt.CountIntron {
+									c.Packets[c.LastPacket].Region = overlap.Region()
+									for icm, cm := range opt.CountMultis {
+										if pairMulti <= cm {
+											c.Packets[c.LastPacket].RegionCounts[icm] += pairFraction
 										}
-										if err != nil {
-											return err
+									}
+								}
+								// Group of feature
+								if doGroup {
+									newGroup := true
+									for ig, gid := range pairGroups {
+										if gid == groupIDs[featID] {
+											pairGroupCounts[ig] += float64(overlapFraction)
+											newGroup = false
+											break
 										}
 									}
-									// Add read to profile
-									if coordProfileInside {
-										apairKeep = true
+									if newGroup {
+										pairGroups = append(pairGroups, groupIDs[featID])
+										pairGroupCounts = append(pairGroupCounts, float64(overlapFraction))
 									}
 								}
-
-								// Count
-								if countInProfile == false || coordProfileInside {
-									for icm, cm := range countMultis {
-										if pairMulti <= cm {
-											apairKeep = true
-											c.Packets[c.LastPacket].Counts[icm] += 1. / float64(pairMulti)
+								// Junctions (counted once per pair)
+								if doJunction {
+									pairJunctions = pairJunctions[:0]
+									for ir, aread := range pair.Reads {
+										if overlap.Read[ir] {
+											pairJunctions = feature.ReadJunctions(aread, pairJunctions)
+										}
+									}
+									for ij, junction := range pairJunctions {
+										newJunction := true
+										for _, pj := range pairJunctions[:ij] {
+											if pj == junction {
+												newJunction = false
+												break
+											}
+										}
+										if !newJunction {
+											continue
+										}
+										key := feature.Junction{ID: feat.ID, Start: junction[0], End: junction[1]}
+										counts, ok := c.Junctions[key]
+										if !ok {
+											counts = make([]float64, len(opt.CountMultis))
+											c.Junctions[key] = counts
+										}
+										for icm, cm := range opt.CountMultis {
+											if pairMulti <= cm {
+												counts[icm] += pairFraction
+											}
 										}
 									}
 								}
-								c.LastPacket++
 							}
+							c.LastPacket++
+						}
+						// Count pair once per group
+						for ig, gid := range pairGroups {
+							if len(c.Packets) <= c.LastPacket {
+								c.Grow()
+							}
+							c.Packets[c.LastPacket].ID = gid
+							c.Packets[c.LastPacket].Group = true
+							if pairGroupCounts[ig] > 1. {
+								pairGroupCounts[ig] = 1.
+							}
+							for icm, cm := range opt.CountMultis {
+								if pairMulti <= cm {
+									c.Packets[c.LastPacket].Counts[icm] += pairGroupCounts[ig] / float64(pairMulti)
+								}
+							}
+							c.LastPacket++
 						}
 						if apairKeep {
 							iMulti := 0
-							for icm, cm := range countMultis {
+							for icm, cm := range opt.CountMultis {
 								if pairMulti <= cm {
 									iMulti = icm
 									break
 								}
 							}
-							if countTotalRealRead {
-								multiSets[iMulti].Add(aread.Name)
+							if opt.CountTotalRealRead {
+								multiSets[iMulti].Add(pair.Reads[0].Name)
 							} else {
 								c.MultiCounts[iMulti] += 1. / float64(pairMulti)
 							}
@@ -595,15 +1138,77 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 	})
 
 	// Combine data from worker into final count and profile
-	nMulti := len(countMultis)
+	nMulti := len(opt.CountMultis)
+	countStride := 1 + len(opt.CountUnits)
+	var ambiguousCount float64
+	mergeCacheTotals := func(c *Cache) {
+		// Total count
+		if !opt.CountTotalRealRead {
+			for i := 0; i < nMulti; i++ {
+				multisCounts[i] += c.MultiCounts[i]
+				c.MultiCounts[i] = 0.
+			}
+		}
+		// Input count
+		inputCount += c.InputCount
+		c.InputCount = 0.
+		// Ambiguous count
+		ambiguousCount += c.AmbiguousCount
+		c.AmbiguousCount = 0.
+		// Frame counts per read length
+		for length, fc := range c.FrameLengths {
+			fl, ok := frameLengths[length]
+			if !ok {
+				fl = &profile.FrameCounts{}
+				frameLengths[length] = fl
+			}
+			for i := 0; i < 3; i++ {
+				fl[i] += fc[i]
+			}
+			delete(c.FrameLengths, length)
+		}
+		// Junction counts
+		for key, jc := range c.Junctions {
+			counts, ok := junctionCounts[key]
+			if !ok {
+				counts = make([]float64, nMulti)
+				junctionCounts[key] = counts
+			}
+			for i := 0; i < nMulti; i++ {
+				counts[i] += jc[i]
+			}
+			delete(c.Junctions, key)
+		}
+		// Cell UMIs
+		for key := range c.CellUMIs {
+			cellUMIs[key] = true
+			delete(c.CellUMIs, key)
+		}
+		// Offset metagene
+		if doOffset {
+			offsetMetagene.Merge(c.OffsetMetagene)
+		}
+	}
 	for c := range chFinal {
 		for i := 0; i < c.LastPacket; i++ {
 			//DEBUG_PAIR fmt.Println("PACKET", i)
+			// Group count
+			if c.Packets[i].Group {
+				for j := 0; j < nMulti; j++ {
+					groupExts[c.Packets[i].ID].Counts[1+(countStride*j)] += c.Packets[i].Counts[j]
+					c.Packets[i].Counts[j] = 0
+				}
+				continue
+			}
 			// Count
 			for j := 0; j < nMulti; j++ {
-				featureExts[c.Packets[i].ID].Counts[1+(2*j)] += c.Packets[i].Counts[j]
+				featureExts[c.Packets[i].ID].Counts[1+(countStride*j)] += c.Packets[i].Counts[j]
 				c.Packets[i].Counts[j] = 0
 			}
+			if doEM {
+				featureExts[c.Packets[i].ID].Counts[1+(countStride*nMulti)] += c.Packets[i].EMCount
+				c.Packets[i].EMCount = 0
+			}
 			// Profile
 			if doProfile {
 				for j := 0; j <= c.Packets[i].ProfileChanges.ProfileLastIdx; j++ {
@@ -612,15 +1217,20 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 				}
 				c.Packets[i].ProfileChanges.ProfileLastIdx = -1
 			}
+			// Region count
+			if c.Packets[i].Region != -1 {
+				for j := 0; j < nMulti; j++ {
+					featureExts[c.Packets[i].ID].RegionCounts[len(feature.RegionNames)*j+c.Packets[i].Region] += c.Packets[i].RegionCounts[j]
+					c.Packets[i].RegionCounts[j] = 0
+				}
+			}
+			// Frame
+			if c.Packets[i].Frame != -1 {
+				frameFeatures[c.Packets[i].ID][c.Packets[i].Frame] += float64(c.Packets[i].FrameCount)
+			}
 		}
-		// Total count
-		for i := 0; i < nMulti; i++ {
-			multisCounts[i] += c.MultiCounts[i]
-			c.MultiCounts[i] = 0.
-		}
-		// Input count
-		inputCount += c.InputCount
-		c.InputCount = 0.
+		// Totals
+		mergeCacheTotals(c)
 		// Reset
 		c.LastPacket = 0
 		pool <- c
@@ -630,40 +1240,58 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 	if err != nil {
 		return nAlign, err
 	}
+	// Totals left in caches not sent to the combining loop
+	for i := 0; i < cap(pool); i++ {
+		mergeCacheTotals(<-pool)
+	}
 
 	// Normalization
 	// Total length
-	for i := 0; i < len(featureExts); i++ {
-		countTotals[0] += featureExts[i].Counts[0]
+	for i := 0; i < len(countExts); i++ {
+		opt.CountTotals[0] += countExts[i].Counts[0]
 	}
 	// Total counts
-	if !countTotalInput {
+	if !opt.CountTotalInput {
 		var c int
 		var p float64
-		for icm := 0; icm < len(countMultis); icm++ {
-			if countTotalRealRead {
+		for icm := 0; icm < len(opt.CountMultis); icm++ {
+			if opt.CountTotalRealRead {
 				c += multiSets[icm].Size()
-				countTotals[1+(2*icm)] = float64(c)
+				opt.CountTotals[1+(countStride*icm)] = float64(c)
 			} else {
 				p += multisCounts[icm]
-				countTotals[1+(2*icm)] = p
+				opt.CountTotals[1+(countStride*icm)] = p
 			}
 		}
 	}
-	// Normalize counts to RPKM
-	for icm := 0; icm < len(countMultis); icm++ {
-		col := 1 + (2 * icm)
-		if countTotals[col] > 0. {
-			for _, feat := range featureExts {
-				feat.Counts[col+1] = feat.Counts[col] * (1000. / feat.Counts[0]) * (1000000. / countTotals[col])
+	// EM total: total of the highest multiplicity
+	if doEM {
+		for icm, cm := range opt.CountMultis {
+			if cm == emMulti {
+				opt.CountTotals[1+(countStride*nMulti)] = opt.CountTotals[1+(countStride*icm)]
+				break
 			}
-			countTotals[col+1] = countTotals[col] * (1000. / countTotals[0]) * (1000000. / countTotals[col])
 		}
 	}
+	// Group totals: same library totals with total length of groups
+	var groupTotals []float64
+	if doGroup {
+		groupTotals = make([]float64, 1+nMulti*countStride)
+		copy(groupTotals, opt.CountTotals)
+		groupTotals[0] = 0.
+		for _, ge := range groupExts {
+			groupTotals[0] += ge.Counts[0]
+		}
+	}
+	// Normalize counts (RPKM, TPM or CPM)
+	feature.NormalizeCounts(countExts, countCols, opt.CountUnits, opt.CountTotals)
+	if doGroup {
+		feature.NormalizeCounts(groupExts, opt.CountMultis, opt.CountUnits, groupTotals)
+	}
 	// Normalize profiles to RPM
-	if doProfile && profileNorm {
-		normFactor := float32(1000000. / countTotals[profileMultiTotalCol])
-		if verboseLevel > 0 {
+	if doProfile && opt.ProfileNorm {
+		normFactor := float32(1000000. / opt.CountTotals[opt.ProfileMultiTotalCol])
+		if opt.VerboseLevel > 0 {
 			timeNow := time.Now()
 			fmt.Printf("%.1fmin - Profile norm. factor: %f\n", timeNow.Sub(timeStart).Minutes(), normFactor)
 		}
@@ -675,25 +1303,183 @@ func PConFeature(pathSAMs []esam.PathSAM, SAMCmdIn []string, features []feature.
 	}
 
 	// Output: Count
-	if countPath != "" {
-		err = feature.WriteCounts(featureExts, countPath, countMultis, countTotals, appendOutput)
+	if opt.CountPath != "" {
+		err = feature.WriteCounts(countExts, opt.CountPath, countCols, opt.CountUnits, opt.CountTotals, opt.CountIntron, opt.AppendOutput)
+		if err != nil {
+			return nAlign, err
+		}
+	}
+	// Output: Group count
+	if doGroup {
+		err = feature.WriteCounts(groupExts, opt.CountGroupPath, opt.CountMultis, opt.CountUnits, groupTotals, false, opt.AppendOutput)
+		if err != nil {
+			return nAlign, err
+		}
+	}
+	// Output: Cell count
+	if doCell {
+		err = feature.WriteMatrix(countExts, cellUMIs, opt.CellPath)
+		if err != nil {
+			return nAlign, err
+		}
+	}
+	// Output: Junction count
+	if doJunction {
+		err = feature.WriteJunctions(countExts, junctionCounts, opt.JunctionPath, opt.CountMultis, opt.AppendOutput)
+		if err != nil {
+			return nAlign, err
+		}
+	}
+	// Output: Metagene
+	if doProfile && opt.MetagenePath != "" {
+		metagenes := profile.ComputeMetagenes(countExts, opt.MetageneLandmarks, opt.MetageneWindow, opt.ProfileOverhang, opt.MetageneNorm, opt.MetageneMean)
+		err = profile.WriteMetagenes(opt.MetagenePath, metagenes, opt.MetageneWindow)
 		if err != nil {
 			return nAlign, err
 		}
 	}
 	// Output: Profile
 	if doProfile {
-		for ip := 0; ip < len(profileFormats); ip++ {
-			if verboseLevel > 0 {
-				timeNow := time.Now()
-				fmt.Printf("%.1fmin - Writing %s output in %s\n", timeNow.Sub(timeStart).Minutes(), profileFormats[ip], profilePaths[ip])
+		// Profiles and output path(s) per strand
+		strandExts := [][]*feature.FeatureExt{featureExts}
+		strandSuffixes := []string{""}
+		if opt.ProfileStranded {
+			var plusExts, minusExts []*feature.FeatureExt
+			for _, feat := range featureExts {
+				if feat.Strand == 1 {
+					plusExts = append(plusExts, feat)
+				} else {
+					minusExts = append(minusExts, feat)
+				}
+			}
+			strandExts = [][]*feature.FeatureExt{plusExts, minusExts}
+			strandSuffixes = []string{"plus", "minus"}
+		}
+		// Profiles and output path(s) per channel
+		var outExts [][]*feature.FeatureExt
+		var outSuffixes [][]string
+		for is, exts := range strandExts {
+			var strandOutExts [][]*feature.FeatureExt
+			if len(channelNames) == 0 {
+				strandOutExts = append(strandOutExts, exts)
+				outSuffixes = append(outSuffixes, []string{strandSuffixes[is]})
+			} else {
+				channelExts := feature.SplitChannels(exts, nChannel)
+				for ic, name := range channelNames {
+					strandOutExts = append(strandOutExts, channelExts[ic])
+					outSuffixes = append(outSuffixes, []string{strandSuffixes[is], name})
+				}
+				if opt.ProfileType == profile.ProfileTypeMismatch {
+					strandOutExts = append(strandOutExts, profile.MismatchRate(channelExts))
+					outSuffixes = append(outSuffixes, []string{strandSuffixes[is], "rate"})
+				}
+			}
+			// Minus strand profiles (and rates) with negative values
+			if opt.ProfileMinusNegative && strandSuffixes[is] == "minus" {
+				for _, oexts := range strandOutExts {
+					for _, feat := range oexts {
+						for ip := 0; ip < len(feat.Profile); ip++ {
+							feat.Profile[ip] = -feat.Profile[ip]
+						}
+					}
+				}
+			}
+			outExts = append(outExts, strandOutExts...)
+		}
+		// Base channels are written together in binary and CSV outputs
+		var strandOutSuffixes [][]string
+		for _, suffix := range strandSuffixes {
+			strandOutSuffixes = append(strandOutSuffixes, []string{suffix})
+		}
+		for ip := 0; ip < len(opt.ProfileFormats); ip++ {
+			formatExts, formatSuffixes := outExts, outSuffixes
+			if format := strings.Split(opt.ProfileFormats[ip], "+")[0]; opt.ProfileType == profile.ProfileTypeBase && (format == "binary" || format == "csv") {
+				formatExts, formatSuffixes = strandExts, strandOutSuffixes
+			}
+			for io, exts := range formatExts {
+				profilePath := opt.ProfilePaths[ip]
+				for _, suffix := range formatSuffixes[io] {
+					profilePath = SuffixPath(profilePath, suffix)
+				}
+				if opt.VerboseLevel > 0 {
+					timeNow := time.Now()
+					fmt.Printf("%.1fmin - Writing %s output in %s\n", timeNow.Sub(timeStart).Minutes(), opt.ProfileFormats[ip], profilePath)
+				}
+				err = feature.WriteProfiles(exts, featuresMapping, profilePath, opt.ProfileFormats[ip], opt.AppendOutput)
+				if err != nil {
+					return nAlign, err
+				}
 			}
-			feature.WriteProfiles(featureExts, featuresMapping, profilePaths[ip], profileFormats[ip], appendOutput)
+		}
+	}
+	// Output: Frame counts
+	if opt.ProfileType == profile.ProfileTypeFrame {
+		if opt.FramePath != "" {
+			names := make([]string, len(frameFeatures))
+			for i := range frameFeatures {
+				names[i] = featureExts[i].Name
+				// Feature on opposite strand
+				if uint32(i) >= nCount {
+					names[i] += "_antisense"
+				}
+			}
+			err = profile.WriteFrameCounts(opt.FramePath, "name", names, frameFeatures)
+			if err != nil {
+				return nAlign, err
+			}
+		}
+		if opt.FrameLengthPath != "" {
+			var lengths []int
+			for length := range frameLengths {
+				lengths = append(lengths, length)
+			}
+			sort.Ints(lengths)
+			keys := make([]string, len(lengths))
+			counts := make([]profile.FrameCounts, len(lengths))
+			for i, length := range lengths {
+				keys[i] = strconv.Itoa(length)
+				counts[i] = *frameLengths[length]
+			}
+			err = profile.WriteFrameCounts(opt.FrameLengthPath, "read_length", keys, counts)
+			if err != nil {
+				return nAlign, err
+			}
+		}
+	}
+	// Output: Offsets
+	if opt.OffsetMetagenePath != "" {
+		err = offsetMetagene.Write(opt.OffsetMetagenePath)
+		if err != nil {
+			return nAlign, err
+		}
+	}
+	if opt.OffsetEstimatePath != "" {
+		offsets := offsetMetagene.Estimate()
+		if opt.VerboseLevel > 0 {
+			timeNow := time.Now()
+			for _, length := range offsetMetagene.Lengths() {
+				if offset, ok := offsets[length]; ok {
+					fmt.Printf("%.1fmin - Offset for read length %d: %d\n", timeNow.Sub(timeStart).Minutes(), length, offset)
+				}
+			}
+		}
+		err = profile.WriteOffsets(opt.OffsetEstimatePath, offsets)
+		if err != nil {
+			return nAlign, err
 		}
 	}
 	// Output: Report
-	if pathReport != "" {
-		err = WriteReport(pathReport, inputCount, countMultis, countTotalRealRead, multiSets, multisCounts)
+	if opt.PathReport != "" {
+		var duplicates map[string]uint32
+		if doDedup {
+			duplicates = make(map[string]uint32)
+			for i, feat := range countExts {
+				if dedupCounts[i] > 0 {
+					duplicates[feat.Name] = dedupCounts[i]
+				}
+			}
+		}
+		err = WriteReport(opt.PathReport, inputCount, opt.CountMultis, opt.CountTotalRealRead, multiSets, multisCounts, ambiguousCount, duplicates, umiMissing)
 		if err != nil {
 			return nAlign, err
 		}
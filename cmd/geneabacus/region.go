@@ -0,0 +1,116 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/bgzf"
+	"github.com/biogo/hts/bgzf/index"
+	"github.com/biogo/hts/csi"
+	"github.com/biogo/hts/sam"
+)
+
+// RegionReader reads the records of a BAM file within chunks found using the BAM index
+type RegionReader struct {
+	*bam.Reader
+	it *bam.Iterator
+}
+
+func NewRegionReader(br *bam.Reader, chunks []bgzf.Chunk) (*RegionReader, error) {
+	rr := RegionReader{Reader: br}
+	if len(chunks) > 0 {
+		it, err := bam.NewIterator(br, chunks)
+		if err != nil {
+			return nil, err
+		}
+		rr.it = it
+	}
+	return &rr, nil
+}
+
+func (rr *RegionReader) Read() (*sam.Record, error) {
+	// No chunk to read
+	if rr.it == nil {
+		return nil, io.EOF
+	}
+	if rr.it.Next() {
+		return rr.it.Record(), nil
+	}
+	if err := rr.it.Error(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// FindBAMIndex returns the path to the index (.bai or .csi) of the BAM file at path, or an empty string if no index is found.
+func FindBAMIndex(path string) string {
+	for _, p := range []string{path + ".bai", strings.TrimSuffix(path, ".bam") + ".bai", path + ".csi"} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// BAMIndexChunks returns the chunks of the BAM file overlapping regions (per chromosome) using the index at indexPath.
+func BAMIndexChunks(indexPath string, header *sam.Header, regions map[string][][]int) ([]bgzf.Chunk, error) {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Chunks per region
+	var chunksFn func(ref *sam.Reference, beg, end int) ([]bgzf.Chunk, error)
+	if strings.HasSuffix(indexPath, ".csi") {
+		idx, err := csi.ReadFrom(f)
+		if err != nil {
+			return nil, err
+		}
+		chunksFn = func(ref *sam.Reference, beg, end int) ([]bgzf.Chunk, error) {
+			return idx.Chunks(ref.ID(), beg, end), nil
+		}
+	} else {
+		idx, err := bam.ReadIndex(f)
+		if err != nil {
+			return nil, err
+		}
+		chunksFn = func(ref *sam.Reference, beg, end int) ([]bgzf.Chunk, error) {
+			chunks, err := idx.Chunks(ref, beg, end)
+			// Reference or region without reads
+			if errors.Is(err, index.ErrNoReference) || errors.Is(err, index.ErrInvalid) {
+				return nil, nil
+			}
+			return chunks, err
+		}
+	}
+	var chunks []bgzf.Chunk
+	for _, ref := range header.Refs() {
+		for _, region := range regions[ref.Name()] {
+			rc, err := chunksFn(ref, region[0], region[1])
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, rc...)
+		}
+	}
+	// Merge overlapping chunks so that each record is read once
+	sort.Slice(chunks, func(i, j int) bool { return chunkOffset(chunks[i].Begin) < chunkOffset(chunks[j].Begin) })
+	return index.Adjacent(chunks), nil
+}
+
+// chunkOffset returns the virtual file offset.
+func chunkOffset(o bgzf.Offset) int64 {
+	return o.File<<16 | int64(o.Block)
+}
@@ -0,0 +1,163 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+)
+
+// writeTestBAM writes a coordinate-sorted BAM with 20 bases reads every 10 bases on chr1 and chr2 (from 0 to 2000) and its index (.bai) in dir. It returns the path to the BAM file.
+func writeTestBAM(t *testing.T, dir string) string {
+	t.Helper()
+	header := testHeader(t)
+	header.SortOrder = sam.Coordinate
+	var lines []string
+	for _, ref := range []string{"chr1", "chr2"} {
+		for pos := 0; pos < 2000; pos += 10 {
+			lines = append(lines, fmt.Sprintf("%s_%d 0 %s %d 255 20M * 0 0 %s *", ref, pos, ref, pos+1, strings.Repeat("A", 20)))
+		}
+	}
+	// BAM
+	path := filepath.Join(dir, "reads.bam")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bam.NewWriter(f, header, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range testSAM(t, header, lines...) {
+		if err = bw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Index
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br, err := bam.NewReader(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idx bam.Index
+	for {
+		r, err := br.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err = idx.Add(r, br.LastChunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Create(path + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+	if err = bam.WriteIndex(fi, &idx); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindBAMIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "reads.bam")
+	if got := FindBAMIndex(path); got != "" {
+		t.Errorf("no index: got %s", got)
+	}
+	for _, indexPath := range []string{path + ".csi", filepath.Join(dir, "reads.bai"), path + ".bai"} {
+		if err := os.WriteFile(indexPath, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := FindBAMIndex(path); got != indexPath {
+			t.Errorf("got %s, want %s", got, indexPath)
+		}
+	}
+}
+
+func TestRegionReader(t *testing.T) {
+	path := writeTestBAM(t, t.TempDir())
+	tests := []struct {
+		name    string
+		regions map[string][][]int
+	}{
+		{"no region", map[string][][]int{}},
+		{"one region", map[string][][]int{"chr1": {{500, 600}}}},
+		{"regions sharing chunks", map[string][][]int{"chr1": {{100, 300}, {200, 500}, {1500, 1510}}, "chr2": {{0, 10}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			br, err := bam.NewReader(f, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks, err := BAMIndexChunks(FindBAMIndex(path), br.Header(), tt.regions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr, err := NewRegionReader(br, chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]int)
+			for {
+				r, err := rr.Read()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				seen[r.Name]++
+			}
+			// Each record is read once
+			for name, n := range seen {
+				if n != 1 {
+					t.Errorf("%s read %d times", name, n)
+				}
+			}
+			// Records overlapping regions are read (chunks may include other records)
+			for chrom, regions := range tt.regions {
+				for _, region := range regions {
+					for pos := 0; pos < 2000; pos += 10 {
+						name := fmt.Sprintf("%s_%d", chrom, pos)
+						if pos+20 > region[0] && pos < region[1] && seen[name] == 0 {
+							t.Errorf("%s not read", name)
+						}
+					}
+				}
+			}
+			if len(tt.regions) == 0 && len(seen) > 0 {
+				t.Errorf("got %d records, want 0", len(seen))
+			}
+		})
+	}
+}
@@ -16,7 +16,8 @@ import (
 	"gopkg.in/fatih/set.v0"
 )
 
-func WriteReport(pathReport string, inputCount float64, countMultis []int, countTotalRealRead bool, multiSets []set.Interface, multisCounts []float64) (err error) {
+// WriteReport writes the report in JSON. If duplicates is not nil, the number of duplicates removed per feature by UMI deduplication, their total and the number of reads without UMI (umiMissing) are added.
+func WriteReport(pathReport string, inputCount float64, countMultis []int, countTotalRealRead bool, multiSets []set.Interface, multisCounts []float64, ambiguousCount float64, duplicates map[string]uint32, umiMissing uint32) (err error) {
 	countReport := make(map[string]uint32)
 	countReport["input"] = uint32(inputCount)
 	for i := 0; i < len(countMultis); i++ {
@@ -35,7 +36,24 @@ func WriteReport(pathReport string, inputCount float64, countMultis []int, count
 		}
 	}
 	countReport["output"] = countReport["align_unique"] + countReport["align_multi"]
-	report, _ := json.MarshalIndent(countReport, "", "  ")
+	countReport["ambiguous"] = uint32(ambiguousCount)
+	var report []byte
+	if duplicates != nil {
+		fullReport := make(map[string]interface{})
+		for k, v := range countReport {
+			fullReport[k] = v
+		}
+		var duplicate uint32
+		for _, d := range duplicates {
+			duplicate += d
+		}
+		fullReport["duplicate"] = duplicate
+		fullReport["duplicate_features"] = duplicates
+		fullReport["umi_missing"] = umiMissing
+		report, _ = json.MarshalIndent(fullReport, "", "  ")
+	} else {
+		report, _ = json.MarshalIndent(countReport, "", "  ")
+	}
 	if pathReport != "-" {
 		if f, err := os.Create(pathReport); err != nil {
 			return err
@@ -0,0 +1,117 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+)
+
+const (
+	AlignmentSelectAll = iota
+	AlignmentSelectNoSecondary
+	AlignmentSelectPrimary
+	AlignmentSelectBest
+)
+
+// GroupPairs combines the alignments of one read (records with the same name) into pairs. Mates of paired-end reads are paired using the HI tag, or in order of appearance without HI tag. Unmapped reads and supplementary alignments are ignored.
+func GroupPairs(records []*sam.Record, paired bool) []*Pair {
+	var pairs []*Pair
+	if !paired {
+		for _, r := range records {
+			if r.Flags&sam.Unmapped != 0 || r.Flags&sam.Supplementary != 0 {
+				continue
+			}
+			pairs = append(pairs, &Pair{Reads: []*sam.Record{r}})
+		}
+		return pairs
+	}
+	// Mates per hit
+	var hits [][2]*sam.Record
+	hitIdx := make(map[int]int)
+	var nMate [2]int
+	for _, r := range records {
+		if r.Flags&sam.Unmapped != 0 || r.Flags&sam.Supplementary != 0 {
+			continue
+		}
+		mate := 0
+		if r.Flags&sam.Read2 != 0 {
+			mate = 1
+		}
+		hi, ok := esam.TagInt(r, []byte{'H', 'I'})
+		if !ok {
+			hi = nMate[mate]
+		}
+		nMate[mate]++
+		i, ok := hitIdx[hi]
+		if !ok || hits[i][mate] != nil {
+			i = len(hits)
+			hitIdx[hi] = i
+			hits = append(hits, [2]*sam.Record{})
+		}
+		hits[i][mate] = r
+	}
+	for _, hit := range hits {
+		var pair Pair
+		if hit[0] != nil && hit[1] != nil {
+			pair.Reads = []*sam.Record{hit[0], hit[1]}
+		} else if hit[0] != nil {
+			pair.Reads = []*sam.Record{hit[0]}
+			pair.OnlyRead1 = true
+		} else {
+			pair.Reads = []*sam.Record{hit[1]}
+		}
+		pairs = append(pairs, &pair)
+	}
+	return pairs
+}
+
+// SelectPairs selects the alignments of one read. With AlignmentSelectNoSecondary, secondary alignments are removed (multiplicity from NH tag). With AlignmentSelectPrimary, only the primary alignment is kept as unique. With AlignmentSelectBest, only the alignment(s) with the highest alignment score (AS tag, summed over mates) are kept, multiplicity being the number of kept alignments.
+func SelectPairs(pairs []*Pair, alignmentSelect int) ([]*Pair, error) {
+	var selected []*Pair
+	switch alignmentSelect {
+	case AlignmentSelectNoSecondary, AlignmentSelectPrimary:
+		for _, pair := range pairs {
+			if pair.Reads[0].Flags&sam.Secondary == 0 {
+				if alignmentSelect == AlignmentSelectPrimary {
+					pair.Multi = 1
+				}
+				selected = append(selected, pair)
+			}
+		}
+	case AlignmentSelectBest:
+		var bestScore int
+		for _, pair := range pairs {
+			var score int
+			for _, r := range pair.Reads {
+				s, ok := esam.TagInt(r, []byte{'A', 'S'})
+				if !ok {
+					return nil, fmt.Errorf("Missing AS tag for %s", r.Name)
+				}
+				score += s
+			}
+			if len(selected) == 0 || score > bestScore {
+				bestScore = score
+				selected = selected[:0]
+			}
+			if score == bestScore {
+				selected = append(selected, pair)
+			}
+		}
+		for _, pair := range selected {
+			pair.Multi = len(selected)
+		}
+	default:
+		selected = pairs
+	}
+	return selected, nil
+}
@@ -0,0 +1,151 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+// testHeader returns a header with references chr1 and chr2.
+func testHeader(t *testing.T) *sam.Header {
+	t.Helper()
+	var refs []*sam.Reference
+	for _, name := range []string{"chr1", "chr2"} {
+		ref, err := sam.NewReference(name, "", "", 1000000, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// testSAM parses lines with header, fields split on whitespace.
+func testSAM(t *testing.T, header *sam.Header, lines ...string) []*sam.Record {
+	t.Helper()
+	var records []*sam.Record
+	for _, line := range lines {
+		var r sam.Record
+		if err := r.UnmarshalSAM(header, []byte(strings.Join(strings.Fields(line), "\t"))); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &r)
+	}
+	return records
+}
+
+// pairString returns the 1-based positions of the reads of pair, with "only1" if only read 1 is present.
+func pairString(pair *Pair) string {
+	var s []string
+	for _, r := range pair.Reads {
+		s = append(s, strconv.Itoa(r.Pos+1))
+	}
+	if pair.OnlyRead1 {
+		s = append(s, "only1")
+	}
+	return strings.Join(s, ",")
+}
+
+func TestGroupPairs(t *testing.T) {
+	tests := []struct {
+		name   string
+		paired bool
+		lines  []string
+		want   []string
+	}{
+		{"single-end", false, []string{
+			"r 0 chr1 101 255 10M * 0 0 AAAAAAAAAA *",
+			"r 4 chr1 201 255 10M * 0 0 AAAAAAAAAA *",
+			"r 2048 chr1 301 255 10M * 0 0 AAAAAAAAAA *",
+			"r 256 chr1 401 255 10M * 0 0 AAAAAAAAAA *",
+		}, []string{"101", "401"}},
+		{"paired HI", true, []string{
+			"r 65 chr1 101 255 10M = 501 0 AAAAAAAAAA * HI:i:1",
+			"r 321 chr1 201 255 10M = 601 0 AAAAAAAAAA * HI:i:2",
+			"r 385 chr1 601 255 10M = 201 0 AAAAAAAAAA * HI:i:2",
+			"r 129 chr1 501 255 10M = 101 0 AAAAAAAAAA * HI:i:1",
+		}, []string{"101,501", "201,601"}},
+		{"paired no HI", true, []string{
+			"r 65 chr1 101 255 10M = 501 0 AAAAAAAAAA *",
+			"r 129 chr1 501 255 10M = 101 0 AAAAAAAAAA *",
+			"r 321 chr1 201 255 10M = 601 0 AAAAAAAAAA *",
+			"r 385 chr1 601 255 10M = 201 0 AAAAAAAAAA *",
+		}, []string{"101,501", "201,601"}},
+		{"paired single mate", true, []string{
+			"r 73 chr1 101 255 10M = 101 0 AAAAAAAAAA * HI:i:1",
+			"r 133 chr1 101 255 * = 101 0 AAAAAAAAAA * HI:i:1",
+			"r 137 chr1 201 255 10M = 201 0 AAAAAAAAAA * HI:i:2",
+		}, []string{"101,only1", "201"}},
+	}
+	header := testHeader(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, pair := range GroupPairs(testSAM(t, header, tt.lines...), tt.paired) {
+				got = append(got, pairString(pair))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectPairs(t *testing.T) {
+	// Primary alignment with AS 40, and two secondary alignments with AS 50
+	lines := []string{
+		"r 0 chr1 101 255 10M * 0 0 AAAAAAAAAA * NH:i:3 AS:i:40",
+		"r 256 chr1 201 255 10M * 0 0 AAAAAAAAAA * NH:i:3 AS:i:50",
+		"r 256 chr1 301 255 10M * 0 0 AAAAAAAAAA * NH:i:3 AS:i:50",
+	}
+	tests := []struct {
+		name            string
+		alignmentSelect int
+		want            []string
+		wantMulti       int
+	}{
+		{"all", AlignmentSelectAll, []string{"101", "201", "301"}, 0},
+		{"no-secondary", AlignmentSelectNoSecondary, []string{"101"}, 0},
+		{"primary", AlignmentSelectPrimary, []string{"101"}, 1},
+		{"best", AlignmentSelectBest, []string{"201", "301"}, 2},
+	}
+	header := testHeader(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, err := SelectPairs(GroupPairs(testSAM(t, header, lines...), false), tt.alignmentSelect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, pair := range pairs {
+				got = append(got, pairString(pair))
+				if pair.Multi != tt.wantMulti {
+					t.Errorf("got multiplicity %d, want %d", pair.Multi, tt.wantMulti)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Best selection requires AS tag
+	pairs := GroupPairs(testSAM(t, header, "r 0 chr1 101 255 10M * 0 0 AAAAAAAAAA *"), false)
+	if _, err := SelectPairs(pairs, AlignmentSelectBest); err == nil {
+		t.Error("got nil error for missing AS tag")
+	}
+}
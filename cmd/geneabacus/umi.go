@@ -0,0 +1,88 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// Distance between two removals of passed UMIs from memory with sorted input
+const umiSweepLength = 100000
+
+// UMIKey identifies reads with the same UMI, 5' end position and strand overlapping a feature
+type UMIKey struct {
+	UMI     string
+	Ref     int
+	Pos     int
+	Strand  int8
+	Feature uint32
+}
+
+// NewUMIKey returns the key of the first read of pair. It returns false if the read has no UMI.
+func NewUMIKey(pair *Pair, umiSource string) (UMIKey, bool) {
+	aread := pair.Reads[0]
+	umi, ok := esam.ReadUMI(aread, umiSource)
+	if !ok {
+		return UMIKey{}, false
+	}
+	key := UMIKey{UMI: umi, Ref: aread.Ref.ID(), Strand: aread.Strand()}
+	if key.Strand == 1 {
+		key.Pos = aread.Start()
+	} else {
+		key.Pos = aread.End() - 1
+	}
+	return key, true
+}
+
+// UMIDedup marks duplicate reads/pairs per feature in input order. If Sorted is true (single-end input sorted by coordinate), UMIs are removed from memory once reads have passed their position.
+type UMIDedup struct {
+	Source string
+	Sorted bool
+	seen   map[UMIKey]bool
+	ref    int
+	sweep  int
+}
+
+func NewUMIDedup(source string) *UMIDedup {
+	return &UMIDedup{Source: source, seen: make(map[UMIKey]bool), ref: -2}
+}
+
+// Mark adds to pair.Duplicates the features of overlap already seen with the UMI key of pair. It returns false if the read has no UMI.
+func (d *UMIDedup) Mark(pair *Pair, overlap map[uint32]feature.FeatureOverlap) bool {
+	key, ok := NewUMIKey(pair, d.Source)
+	if !ok {
+		return false
+	}
+	// Next reads start after this read: UMIs with 5' end before can't be seen again
+	if d.Sorted {
+		start := pair.Reads[0].Start()
+		if key.Ref != d.ref {
+			d.seen = make(map[UMIKey]bool)
+			d.ref = key.Ref
+			d.sweep = start
+		} else if start-d.sweep > umiSweepLength {
+			for k := range d.seen {
+				if k.Pos < start {
+					delete(d.seen, k)
+				}
+			}
+			d.sweep = start
+		}
+	}
+	for featID := range overlap {
+		key.Feature = featID
+		if d.seen[key] {
+			pair.Duplicates = append(pair.Duplicates, featID)
+		} else {
+			d.seen[key] = true
+		}
+	}
+	return true
+}
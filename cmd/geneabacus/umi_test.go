@@ -0,0 +1,71 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+func TestUMIDedupMark(t *testing.T) {
+	header := testHeader(t)
+	newPair := func(name string, chrom string, pos int) *Pair {
+		line := fmt.Sprintf("%s 0 %s %d 255 20M * 0 0 %s *", name, chrom, pos+1, strings.Repeat("A", 20))
+		return &Pair{Reads: testSAM(t, header, line)}
+	}
+	overlaps := func(featIDs ...uint32) map[uint32]feature.FeatureOverlap {
+		o := make(map[uint32]feature.FeatureOverlap)
+		for _, featID := range featIDs {
+			o[featID] = feature.FeatureOverlap{}
+		}
+		return o
+	}
+	tests := []struct {
+		name    string
+		pair    *Pair
+		overlap map[uint32]feature.FeatureOverlap
+		want    []uint32
+		seen    int
+	}{
+		{"first", newPair("r1_ACGT", "chr1", 100), overlaps(0), nil, 1},
+		// Duplicate in feature 0 only
+		{"duplicate", newPair("r2_ACGT", "chr1", 100), overlaps(0, 1), []uint32{0}, 2},
+		{"other UMI", newPair("r3_GGGG", "chr1", 100), overlaps(0), nil, 3},
+		// UMIs before position are removed after umiSweepLength
+		{"sweep", newPair("r4_ACGT", "chr1", 100+umiSweepLength+1), overlaps(0), nil, 1},
+		{"other chromosome", newPair("r5_ACGT", "chr2", 100), overlaps(0), nil, 1},
+	}
+	for _, sorted := range []bool{false, true} {
+		dedup := NewUMIDedup("name")
+		dedup.Sorted = sorted
+		for i, tt := range tests {
+			if !dedup.Mark(tt.pair, tt.overlap) {
+				t.Errorf("%s: got missing UMI", tt.name)
+			}
+			if !reflect.DeepEqual(tt.pair.Duplicates, tt.want) {
+				t.Errorf("sorted %v %s: got duplicates %v, want %v", sorted, tt.name, tt.pair.Duplicates, tt.want)
+			}
+			wantSeen := tt.seen
+			if !sorted {
+				wantSeen = []int{1, 2, 3, 4, 5}[i]
+			}
+			if len(dedup.seen) != wantSeen {
+				t.Errorf("sorted %v %s: got %d UMI(s) in memory, want %d", sorted, tt.name, len(dedup.seen), wantSeen)
+			}
+			tt.pair.Duplicates = nil
+		}
+	}
+	if NewUMIDedup("name").Mark(newPair("r6", "chr1", 100), overlaps(0)) {
+		t.Error("got UMI for read without UMI")
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/biogo/store v0.0.0-20201120204734-aad293a2328f
 	github.com/klauspost/compress v1.15.11
 	github.com/pierrec/lz4 v2.6.1+incompatible
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/sync v0.0.0-20220923202941-7f9b1623fab7
 	gopkg.in/fatih/set.v0 v0.2.1
 )
@@ -88,7 +88,7 @@ func GetAln(r *sam.Record) (ref, read, symbol []byte, err error) {
 		if con.Query == 1 && con.Reference == 1 {
 			ref = append(ref, seq[iRead:iRead+length]...)
 			read = append(read, seq[iRead:iRead+length]...)
-			if co.Type() == sam.CigarMatch {
+			if co.Type() == sam.CigarMatch || co.Type() == sam.CigarEqual {
 				symbol = append(symbol, bytes.Repeat([]byte("|"), length)...)
 			} else {
 				symbol = append(symbol, bytes.Repeat([]byte("X"), length)...)
@@ -130,6 +130,10 @@ func GetAln(r *sam.Record) (ref, read, symbol []byte, err error) {
 					iRef++
 				}
 			case MDMismatch:
+				// Skip deletion or intron
+				for iRef < len(ref) && symbol[iRef] == '.' {
+					iRef++
+				}
 				ref[iRef] = b.Seq[0]
 				symbol[iRef] = 'X'
 				iRef++
@@ -146,3 +150,27 @@ func GetAln(r *sam.Record) (ref, read, symbol []byte, err error) {
 	}
 	return
 }
+
+// AlnRefPos returns the reference position of each column of the alignment reconstituted by GetAln. Columns without reference position (insertion, soft clipping or intron) are -1.
+func AlnRefPos(r *sam.Record) (pos []int) {
+	iRef := r.Pos
+	for _, co := range r.Cigar {
+		con := co.Type().Consumes()
+		length := co.Len()
+		if con.Reference == 1 {
+			for i := 0; i < length; i++ {
+				if co.Type() == sam.CigarSkipped {
+					pos = append(pos, -1)
+				} else {
+					pos = append(pos, iRef+i)
+				}
+			}
+			iRef += length
+		} else if con.Query == 1 {
+			for i := 0; i < length; i++ {
+				pos = append(pos, -1)
+			}
+		}
+	}
+	return
+}
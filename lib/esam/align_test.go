@@ -0,0 +1,43 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package esam
+
+import (
+	"testing"
+)
+
+func TestGetAln(t *testing.T) {
+	tests := []struct {
+		name       string
+		read       string
+		wantRef    string
+		wantRead   string
+		wantSymbol string
+	}{
+		{"match", "r1 0 chr1 101 255 8M * 0 0 ACGTACGT *", "ACGTACGT", "ACGTACGT", "||||||||"},
+		{"match MD", "r1 0 chr1 101 255 8M * 0 0 ACGTACGT * MD:Z:0T6G", "TCGTACGG", "ACGTACGT", "X||||||X"},
+		{"equal and mismatch", "r1 0 chr1 101 255 1X6=1X * 0 0 ACGTACGT *", "ACGTACGT", "ACGTACGT", "X||||||X"},
+		{"soft clip and insertion", "r1 0 chr1 101 255 2S3M1I2M * 0 0 ACGTACGT * MD:Z:5", "  GTA-GT", "ACGTACGT", "  |||.||"},
+		// Mismatch following deletion
+		{"deletion MD", "r1 0 chr1 101 255 4M2D4M * 0 0 ACGTACGT * MD:Z:4^GG0T3", "ACGTGGTCGT", "ACGT--ACGT", "||||..X|||"},
+		// Mismatch following intron (absent from MD)
+		{"intron MD", "r1 0 chr1 101 255 4M3N4M * 0 0 ACGTACGT * MD:Z:4T3", "ACGTNNNTCGT", "ACGT---ACGT", "||||...X|||"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, read, symbol, err := GetAln(testRecord(t, tt.read))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(ref) != tt.wantRef || string(read) != tt.wantRead || string(symbol) != tt.wantSymbol {
+				t.Errorf("got\n%q\n%q\n%q\nwant\n%q\n%q\n%q", ref, symbol, read, tt.wantRef, tt.wantSymbol, tt.wantRead)
+			}
+		})
+	}
+}
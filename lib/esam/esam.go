@@ -9,6 +9,8 @@
 package esam
 
 import (
+	"strings"
+
 	"github.com/biogo/hts/sam"
 )
 
@@ -37,6 +39,82 @@ func Overlap(r *sam.Record, start, end int) int {
 	return overlap
 }
 
+// AlignedBlocks returns the reference intervals (0-based [start,end)) of the aligned blocks (i.e. M, = and X operations) of the SAM record.
+func AlignedBlocks(r *sam.Record) (blocks [][]int) {
+	pos := r.Pos
+	for _, co := range r.Cigar {
+		con := co.Type().Consumes()
+		lr := co.Len() * con.Reference
+		if con.Query == 1 && con.Reference == 1 {
+			if n := len(blocks); n > 0 && blocks[n-1][1] == pos {
+				blocks[n-1][1] += lr
+			} else {
+				blocks = append(blocks, []int{pos, pos + lr})
+			}
+		}
+		pos += lr
+	}
+	return blocks
+}
+
+// Junctions returns the reference intervals (0-based [start,end)) of the skipped regions (i.e. N operations, introns) of the SAM record.
+func Junctions(r *sam.Record) (junctions [][]int) {
+	pos := r.Pos
+	for _, co := range r.Cigar {
+		lr := co.Len() * co.Type().Consumes().Reference
+		if co.Type() == sam.CigarSkipped {
+			junctions = append(junctions, []int{pos, pos + lr})
+		}
+		pos += lr
+	}
+	return junctions
+}
+
+// TagString returns the value of the string (Z type) tag of the SAM record.
+func TagString(r *sam.Record, tag []byte) (string, bool) {
+	aux, found := r.Tag(tag)
+	if !found {
+		return "", false
+	}
+	v, ok := aux.Value().(string)
+	return v, ok
+}
+
+// TagInt returns the value of the integer (i type) tag of the SAM record.
+func TagInt(r *sam.Record, tag []byte) (int, bool) {
+	aux, found := r.Tag(tag)
+	if !found {
+		return 0, false
+	}
+	switch v := aux.Value().(type) {
+	case int8:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// ReadUMI returns the UMI of the SAM record from the read name (after the last _ or :) if umiSource is "name" or from the umiSource tag.
+func ReadUMI(r *sam.Record, umiSource string) (string, bool) {
+	if umiSource == "name" {
+		i := strings.LastIndexAny(r.Name, "_:")
+		if i == -1 || i == len(r.Name)-1 {
+			return "", false
+		}
+		return r.Name[i+1:], true
+	}
+	return TagString(r, []byte(umiSource))
+}
+
 func min(a, b int) int {
 	if a > b {
 		return b
@@ -51,6 +129,12 @@ func max(a, b int) int {
 	return a
 }
 
+// isRefSkip returns true if the CIGAR operation only consumes the reference (deletion or intron).
+func isRefSkip(co sam.CigarOp) bool {
+	con := co.Type().Consumes()
+	return con.Query == 0 && con.Reference != 0
+}
+
 // ShiftPos shifts the coordinate within the alignment. If strand is -1, it starts from the alignment end.
 func ShiftPos(pos int, shift int, r *sam.Record, strand int8) (int, bool) {
 	shifted := 0
@@ -66,7 +150,14 @@ func ShiftPos(pos int, shift int, r *sam.Record, strand int8) (int, bool) {
 				shifted += lr
 			} else {
 				if con.Reference != 0 {
-					return pos + ((shift - shifted) * con.Reference), true
+					pos += (shift - shifted) * con.Reference
+					// Shift ending with operation: skip following deletion(s) and intron(s)
+					if shifted+lr == shift {
+						for i++; i < len(r.Cigar) && isRefSkip(r.Cigar[i]); i++ {
+							pos += r.Cigar[i].Len()
+						}
+					}
+					return pos, true
 				} else {
 					return 0, false
 				}
@@ -82,7 +173,14 @@ func ShiftPos(pos int, shift int, r *sam.Record, strand int8) (int, bool) {
 				shifted += lr
 			} else {
 				if con.Reference != 0 {
-					return pos - ((shift - shifted) * con.Reference), true
+					pos -= (shift - shifted) * con.Reference
+					// Shift ending with operation: skip preceding deletion(s) and intron(s)
+					if shifted+lr == shift {
+						for i--; i >= 0 && isRefSkip(r.Cigar[i]); i-- {
+							pos -= r.Cigar[i].Len()
+						}
+					}
+					return pos, true
 				} else {
 					return 0, false
 				}
@@ -0,0 +1,159 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package esam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+// testRecord parses a SAM line on chr1.
+func testRecord(t *testing.T, line string) *sam.Record {
+	t.Helper()
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r sam.Record
+	if err = r.UnmarshalSAM(header, []byte(strings.Join(strings.Fields(line), "\t"))); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+// cigarLine returns a SAM line of a read starting at 0-based position 100 with cigar.
+func cigarLine(t *testing.T, cigar string) string {
+	t.Helper()
+	co, err := sam.ParseCigar([]byte(cigar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lr := co.Lengths()
+	return "r1 0 chr1 101 255 " + cigar + " * 0 0 " + strings.Repeat("A", lr) + " *"
+}
+
+func TestAlignedBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		cigar string
+		want  [][]int
+	}{
+		{"match", "20M", [][]int{{100, 120}}},
+		{"soft clip", "5S20M5S", [][]int{{100, 120}}},
+		{"insertion", "10M5I10M", [][]int{{100, 120}}},
+		{"deletion", "10M2D10M", [][]int{{100, 110}, {112, 122}}},
+		{"intron", "10M100N10M", [][]int{{100, 110}, {210, 220}}},
+		{"match and mismatch", "10=1X9=", [][]int{{100, 120}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AlignedBlocks(testRecord(t, cigarLine(t, tt.cigar))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJunctions(t *testing.T) {
+	tests := []struct {
+		name  string
+		cigar string
+		want  [][]int
+	}{
+		{"match", "20M", nil},
+		{"deletion", "10M2D10M", nil},
+		{"intron", "10M100N10M", [][]int{{110, 210}}},
+		{"introns", "5S10M100N5M2D5M50N10M", [][]int{{110, 210}, {222, 272}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Junctions(testRecord(t, cigarLine(t, tt.cigar))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShiftPos(t *testing.T) {
+	tests := []struct {
+		name       string
+		cigar      string
+		shift      int
+		strand     int8
+		wantPos    int
+		wantInside bool
+	}{
+		{"match", "20M", 5, 1, 105, true},
+		{"match end", "20M", 20, 1, 120, true},
+		{"match reverse", "20M", 5, -1, 114, true},
+		{"intron", "10M100N10M", 12, 1, 212, true},
+		{"intron boundary", "10M100N10M", 10, 1, 210, true},
+		{"intron boundary reverse", "10M100N10M", 10, -1, 109, true},
+		{"deletion boundary", "10M2D10M", 10, 1, 112, true},
+		{"deletion boundary reverse", "10M2D10M", 10, -1, 109, true},
+		{"insertion boundary", "10M5I10M", 10, 1, 110, true},
+		{"insertion", "10M5I10M", 12, 1, 0, false},
+		{"soft clip", "5S20M", 3, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRecord(t, cigarLine(t, tt.cigar))
+			pos := r.Start()
+			if tt.strand == -1 {
+				pos = r.End() - 1
+			}
+			gotPos, gotInside := ShiftPos(pos, tt.shift, r, tt.strand)
+			if gotInside != tt.wantInside || (gotInside && gotPos != tt.wantPos) {
+				t.Errorf("got %d %v, want %d %v", gotPos, gotInside, tt.wantPos, tt.wantInside)
+			}
+		})
+	}
+}
+
+func TestReadUMI(t *testing.T) {
+	tests := []struct {
+		name      string
+		readName  string
+		tags      map[string]string
+		umiSource string
+		want      string
+		wantOK    bool
+	}{
+		{"name underscore", "r1_ACGT", nil, "name", "ACGT", true},
+		{"name colon", "M01:1:FC:1:1101:1000:2000:ACGT", nil, "name", "ACGT", true},
+		{"name last separator", "r1_AAAA_CCCC", nil, "name", "CCCC", true},
+		{"name empty", "r1_", nil, "name", "", false},
+		{"name missing", "r1", nil, "name", "", false},
+		{"tag", "r1_ACGT", map[string]string{"RX": "GGTT"}, "RX", "GGTT", true},
+		{"tag missing", "r1_ACGT", map[string]string{"UB": "GGTT"}, "RX", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRecord(t, cigarLine(t, "20M"))
+			r.Name = tt.readName
+			for tag, value := range tt.tags {
+				aux, err := sam.NewAux(sam.NewTag(tag), value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.AuxFields = append(r.AuxFields, aux)
+			}
+			if got, ok := ReadUMI(r, tt.umiSource); got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q %v, want %q %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
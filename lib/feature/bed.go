@@ -0,0 +1,106 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OpenBED parses a BED file (BED3 to BED12) and returns a list of Feature. BED12 blocks are used as coordinates and thickStart/thickEnd as CDS. Strand is used if the strand column is missing or undefined.
+func OpenBED(bpath string, strand int8) (features []Feature, err error) {
+	bfos, err := OpenFile(bpath)
+	if err != nil {
+		return
+	}
+	defer bfos.Close()
+
+	var i uint32
+	var start, end int
+	bscanner := bufio.NewScanner(bfos)
+	for bscanner.Scan() {
+		line := bscanner.Text()
+		if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			err = fmt.Errorf("Wrong number of fields in %s: %s", bpath, line)
+			return
+		}
+		if start, err = strconv.Atoi(fields[1]); err != nil {
+			return
+		}
+		if end, err = strconv.Atoi(fields[2]); err != nil {
+			return
+		}
+		f := Feature{ID: i, Chrom: fields[0], Strand: strand}
+		// Name
+		if len(fields) > 3 && fields[3] != "" {
+			f.Name = fields[3]
+		} else {
+			f.Name = fmt.Sprintf("%s:%d-%d", fields[0], start, end)
+		}
+		// Strand
+		if len(fields) > 5 {
+			if fields[5] == "+" {
+				f.Strand = 1
+			} else if fields[5] == "-" {
+				f.Strand = -1
+			}
+		}
+		// CDS
+		if len(fields) > 7 {
+			var thickStart, thickEnd int
+			if thickStart, err = strconv.Atoi(fields[6]); err != nil {
+				return
+			}
+			if thickEnd, err = strconv.Atoi(fields[7]); err != nil {
+				return
+			}
+			if thickStart < thickEnd {
+				f.CDS = []int{thickStart, thickEnd}
+			}
+		}
+		// Coordinates
+		if len(fields) > 11 {
+			var blockCount int
+			if blockCount, err = strconv.Atoi(fields[9]); err != nil {
+				return
+			}
+			blockSizes := strings.Split(strings.TrimSuffix(fields[10], ","), ",")
+			blockStarts := strings.Split(strings.TrimSuffix(fields[11], ","), ",")
+			if len(blockSizes) != blockCount || len(blockStarts) != blockCount {
+				err = fmt.Errorf("Wrong number of blocks for %s in %s", f.Name, bpath)
+				return
+			}
+			f.Coords = make([][]int, blockCount)
+			for j := 0; j < blockCount; j++ {
+				var size, bstart int
+				if size, err = strconv.Atoi(blockSizes[j]); err != nil {
+					return
+				}
+				if bstart, err = strconv.Atoi(blockStarts[j]); err != nil {
+					return
+				}
+				f.Coords[j] = []int{start + bstart, start + bstart + size}
+			}
+		} else {
+			f.Coords = [][]int{[]int{start, end}}
+		}
+		features = append(features, f)
+		i++
+	}
+	if err = bscanner.Err(); err != nil {
+		return
+	}
+	return
+}
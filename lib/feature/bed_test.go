@@ -0,0 +1,60 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpenBED(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		dstrand int8
+		want    Feature
+	}{
+		{"BED3", "chr1\t100\t200", 1, Feature{Name: "chr1:100-200", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}}}},
+		{"BED4 empty name", "chr1\t100\t200\t", -1, Feature{Name: "chr1:100-200", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}}}},
+		{"BED6", "chr1\t100\t200\tf1\t0\t-", 1, Feature{Name: "f1", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}}}},
+		{"BED6 undefined strand", "chr1\t100\t200\tf1\t0\t.", -1, Feature{Name: "f1", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}}}},
+		{"BED12", "chr1\t100\t500\tf1\t0\t+\t150\t450\t0\t3\t50,100,60,\t0,200,340,", -1, Feature{Name: "f1", Chrom: "chr1", Strand: 1, CDS: []int{150, 450}, Coords: [][]int{{100, 150}, {300, 400}, {440, 500}}}},
+		{"BED12 no CDS", "chr1\t100\t500\tf1\t0\t+\t100\t100\t0\t2\t50,60\t0,340", 1, Feature{Name: "f1", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 150}, {440, 500}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.bed")
+			if err := os.WriteFile(path, []byte("track name=test\n"+tt.line+"\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			features, err := OpenBED(path, tt.dstrand)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(features) != 1 {
+				t.Fatalf("got %d features, want 1", len(features))
+			}
+			if !reflect.DeepEqual(features[0], tt.want) {
+				t.Errorf("got %+v, want %+v", features[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenBEDWrongBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.bed")
+	if err := os.WriteFile(path, []byte("chr1\t100\t500\tf1\t0\t+\t100\t500\t0\t3\t50,60\t0,340\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBED(path, 1); err == nil {
+		t.Error("got nil error for wrong number of blocks")
+	}
+}
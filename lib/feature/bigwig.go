@@ -0,0 +1,464 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// bigWig format: https://genome.ucsc.edu/goldenPath/help/bigWig.html
+const (
+	bigWigMagic        = 0x888FFC26
+	bigWigVersion      = 4
+	bigWigHeaderSize   = 64
+	bigWigZoomSize     = 24
+	bigWigSummarySize  = 40
+	bigWigBlockSize    = 256
+	bigWigItemsPerSlot = 1024
+	bigWigMaxZoom      = 10
+	bigWigZoomIncrease = 4
+	bptMagic           = 0x78CA8C91
+	cirTreeMagic       = 0x2468ACE0
+)
+
+type bigWigChrom struct {
+	Name    string
+	Size    int
+	Profile []float32
+}
+
+type bigWigItem struct {
+	ChromID    uint32
+	Start, End uint32
+	Value      float32
+}
+
+type bigWigZoomRecord struct {
+	ChromID             uint32
+	Start, End          uint32
+	ValidCount          uint32
+	Min, Max            float32
+	SumData, SumSquares float32
+}
+
+// bigWigBlock is a compressed block of items indexed in the R-tree
+type bigWigBlock struct {
+	StartChromID, EndChromID uint32
+	Start, End               uint32
+	Offset, Size             uint64
+}
+
+// bigWigWriter is a buffered writer keeping the offset of written data
+type bigWigWriter struct {
+	w      *bufio.Writer
+	offset int
+}
+
+func (bw *bigWigWriter) Write(p []byte) (int, error) {
+	n, err := bw.w.Write(p)
+	bw.offset += n
+	return n, err
+}
+
+// Len returns the number of bytes written.
+func (bw *bigWigWriter) Len() int {
+	return bw.offset
+}
+
+// WriteBigWig writes profiles in bigWig format to w. Each profile is a chromosome named after its feature. Blocks are written as they are compressed, and the header is written last by seeking back to the start of w.
+func WriteBigWig(w io.WriteSeeker, featureExts []*FeatureExt, featuresMapping map[string]string) error {
+	// Chromosomes sorted by name
+	chroms := make([]bigWigChrom, len(featureExts))
+	for i, feat := range featureExts {
+		name := feat.Name
+		if len(featuresMapping) > 0 {
+			name = MapName(feat.Name, featuresMapping)
+		}
+		chroms[i] = bigWigChrom{Name: name, Size: len(feat.Profile), Profile: feat.Profile}
+	}
+	sort.Slice(chroms, func(i, j int) bool { return chroms[i].Name < chroms[j].Name })
+	for i := 1; i < len(chroms); i++ {
+		if chroms[i].Name == chroms[i-1].Name {
+			return fmt.Errorf("Duplicate name %s in bigWig", chroms[i].Name)
+		}
+	}
+
+	// Items: steps of constant values (as bedGraph)
+	var items []bigWigItem
+	var maxSize int
+	for ic, chrom := range chroms {
+		var stepStart int
+		var stepValue float32
+		for ip := 0; ip <= len(chrom.Profile); ip++ {
+			var currentValue float32
+			if ip < len(chrom.Profile) {
+				currentValue = chrom.Profile[ip]
+			}
+			if math.Abs(float64(currentValue-stepValue)) > bedGraphPrecision || ip == len(chrom.Profile) {
+				if stepValue != 0. && ip > stepStart {
+					items = append(items, bigWigItem{ChromID: uint32(ic), Start: uint32(stepStart), End: uint32(ip), Value: stepValue})
+				}
+				stepStart = ip
+				stepValue = currentValue
+			}
+		}
+		if chrom.Size > maxSize {
+			maxSize = chrom.Size
+		}
+	}
+
+	// Zoom levels
+	var zooms [][]bigWigZoomRecord
+	var reductions []uint32
+	if len(items) > 0 {
+		var spanSum int
+		for _, it := range items {
+			spanSum += int(it.End - it.Start)
+		}
+		reduction := max(10, 10*spanSum/len(items))
+		lastCount := len(items)
+		for len(zooms) < bigWigMaxZoom && reduction <= max(maxSize, 10) {
+			records := bigWigZoom(items, reduction)
+			if len(records) >= lastCount {
+				break
+			}
+			zooms = append(zooms, records)
+			reductions = append(reductions, uint32(reduction))
+			lastCount = len(records)
+			reduction *= bigWigZoomIncrease
+		}
+	}
+
+	// Header, zoom headers and total summary are filled at the end
+	buf := &bigWigWriter{w: bufio.NewWriter(w)}
+	buf.Write(make([]byte, bigWigHeaderSize+bigWigZoomSize*len(zooms)+bigWigSummarySize))
+	var uncompressBufSize int
+
+	// Chromosome B+ tree
+	chromTreeOffset := uint64(buf.Len())
+	writeBPTree(buf, chroms)
+
+	// Data
+	dataOffset := uint64(buf.Len())
+	// Number of blocks filled after writing blocks
+	binary.Write(buf, binary.LittleEndian, uint64(0))
+	blocks, maxBlockSize, err := writeBlocks(buf, len(items), func(start, end int, w *bytes.Buffer) (bigWigBlock, error) {
+		// Sections must be on one chromosome
+		b := bigWigBlock{StartChromID: items[start].ChromID, EndChromID: items[start].ChromID, Start: items[start].Start}
+		for i := start; i < end; i++ {
+			if items[i].ChromID != b.StartChromID {
+				return b, fmt.Errorf("bigWig section over more than one chromosome")
+			}
+		}
+		b.End = items[end-1].End
+		binary.Write(w, binary.LittleEndian, []uint32{b.StartChromID, b.Start, b.End, 0, 0})
+		binary.Write(w, binary.LittleEndian, []uint8{1, 0})
+		binary.Write(w, binary.LittleEndian, uint16(end-start))
+		for _, it := range items[start:end] {
+			binary.Write(w, binary.LittleEndian, []uint32{it.Start, it.End})
+			binary.Write(w, binary.LittleEndian, it.Value)
+		}
+		return b, nil
+	}, func(i int) uint32 { return items[i].ChromID })
+	if err != nil {
+		return err
+	}
+	uncompressBufSize = max(uncompressBufSize, maxBlockSize)
+	indexOffset := uint64(buf.Len())
+	writeCIRTree(buf, blocks, indexOffset)
+
+	// Zoom data and index
+	zoomOffsets := make([][2]uint64, len(zooms))
+	for iz, records := range zooms {
+		zoomOffsets[iz][0] = uint64(buf.Len())
+		binary.Write(buf, binary.LittleEndian, uint32(len(records)))
+		zblocks, maxBlockSize, err := writeBlocks(buf, len(records), func(start, end int, w *bytes.Buffer) (bigWigBlock, error) {
+			b := bigWigBlock{StartChromID: records[start].ChromID, Start: records[start].Start, EndChromID: records[end-1].ChromID, End: records[end-1].End}
+			for _, r := range records[start:end] {
+				binary.Write(w, binary.LittleEndian, r)
+			}
+			return b, nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+		uncompressBufSize = max(uncompressBufSize, maxBlockSize)
+		zoomOffsets[iz][1] = uint64(buf.Len())
+		writeCIRTree(buf, zblocks, zoomOffsets[iz][1])
+	}
+	// End signature
+	binary.Write(buf, binary.LittleEndian, uint32(bigWigMagic))
+	if err = buf.w.Flush(); err != nil {
+		return err
+	}
+
+	// Number of blocks
+	if _, err = w.Seek(int64(dataOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint64(len(blocks))); err != nil {
+		return err
+	}
+
+	// Header
+	hdr := new(bytes.Buffer)
+	binary.Write(hdr, binary.LittleEndian, uint32(bigWigMagic))
+	binary.Write(hdr, binary.LittleEndian, []uint16{bigWigVersion, uint16(len(zooms))})
+	binary.Write(hdr, binary.LittleEndian, []uint64{chromTreeOffset, dataOffset, indexOffset})
+	binary.Write(hdr, binary.LittleEndian, []uint16{0, 0})
+	binary.Write(hdr, binary.LittleEndian, []uint64{0, uint64(bigWigHeaderSize + bigWigZoomSize*len(zooms))})
+	binary.Write(hdr, binary.LittleEndian, uint32(uncompressBufSize))
+	binary.Write(hdr, binary.LittleEndian, uint64(0))
+	// Zoom headers
+	for iz := range zooms {
+		binary.Write(hdr, binary.LittleEndian, []uint32{reductions[iz], 0})
+		binary.Write(hdr, binary.LittleEndian, []uint64{zoomOffsets[iz][0], zoomOffsets[iz][1]})
+	}
+	// Total summary
+	var basesCovered uint64
+	minVal, maxVal := math.Inf(1), math.Inf(-1)
+	var sumData, sumSquares float64
+	for _, it := range items {
+		size := float64(it.End - it.Start)
+		v := float64(it.Value)
+		basesCovered += uint64(it.End - it.Start)
+		minVal = math.Min(minVal, v)
+		maxVal = math.Max(maxVal, v)
+		sumData += v * size
+		sumSquares += v * v * size
+	}
+	if len(items) == 0 {
+		minVal, maxVal = 0., 0.
+	}
+	binary.Write(hdr, binary.LittleEndian, basesCovered)
+	binary.Write(hdr, binary.LittleEndian, []float64{minVal, maxVal, sumData, sumSquares})
+	if _, err = w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = w.Write(hdr.Bytes())
+	return err
+}
+
+// bigWigZoom summarizes items in bins of reduction length
+func bigWigZoom(items []bigWigItem, reduction int) (records []bigWigZoomRecord) {
+	var cur *bigWigZoomRecord
+	var curBin uint32
+	for _, it := range items {
+		for start := it.Start; start < it.End; {
+			bin := start / uint32(reduction)
+			end := min(int(it.End), int(bin+1)*reduction)
+			size := float32(uint32(end) - start)
+			if cur == nil || cur.ChromID != it.ChromID || curBin != bin {
+				records = append(records, bigWigZoomRecord{ChromID: it.ChromID, Start: start, End: uint32(end), Min: it.Value, Max: it.Value})
+				cur = &records[len(records)-1]
+				curBin = bin
+			}
+			cur.End = uint32(end)
+			cur.ValidCount += uint32(end) - start
+			if it.Value < cur.Min {
+				cur.Min = it.Value
+			}
+			if it.Value > cur.Max {
+				cur.Max = it.Value
+			}
+			cur.SumData += it.Value * size
+			cur.SumSquares += it.Value * it.Value * size
+			start = uint32(end)
+		}
+	}
+	return
+}
+
+// writeBlocks writes zlib-compressed blocks of at most bigWigItemsPerSlot items. If chromID is not nil, blocks are split by chromosome.
+func writeBlocks(buf *bigWigWriter, nItem int, writeItems func(int, int, *bytes.Buffer) (bigWigBlock, error), chromID func(int) uint32) (blocks []bigWigBlock, maxBlockSize int, err error) {
+	raw := new(bytes.Buffer)
+	for start := 0; start < nItem; {
+		end := min(nItem, start+bigWigItemsPerSlot)
+		if chromID != nil {
+			for i := start + 1; i < end; i++ {
+				if chromID(i) != chromID(start) {
+					end = i
+					break
+				}
+			}
+		}
+		raw.Reset()
+		var b bigWigBlock
+		if b, err = writeItems(start, end, raw); err != nil {
+			return
+		}
+		maxBlockSize = max(maxBlockSize, raw.Len())
+		b.Offset = uint64(buf.Len())
+		zw := zlib.NewWriter(buf)
+		if _, err = zw.Write(raw.Bytes()); err != nil {
+			return
+		}
+		if err = zw.Close(); err != nil {
+			return
+		}
+		b.Size = uint64(buf.Len()) - b.Offset
+		blocks = append(blocks, b)
+		start = end
+	}
+	return
+}
+
+// writeBPTree writes the chromosome B+ tree
+func writeBPTree(buf *bigWigWriter, chroms []bigWigChrom) {
+	var keySize int
+	for _, c := range chroms {
+		keySize = max(keySize, len(c.Name))
+	}
+	keySize = max(keySize, 1)
+	blockSize := max(1, min(bigWigBlockSize, len(chroms)))
+	itemCount := len(chroms)
+	binary.Write(buf, binary.LittleEndian, []uint32{bptMagic, uint32(blockSize), uint32(keySize), 8})
+	binary.Write(buf, binary.LittleEndian, []uint64{uint64(itemCount), 0})
+	key := func(i int) []byte {
+		k := make([]byte, keySize)
+		copy(k, chroms[i].Name)
+		return k
+	}
+	// Levels
+	levels := 1
+	for n := itemCount; n > blockSize; levels++ {
+		n = (n + blockSize - 1) / blockSize
+	}
+	bytesInIndexBlock := 4 + blockSize*(keySize+8)
+	bytesInLeafBlock := 4 + blockSize*(keySize+8)
+	// Index levels
+	for level := levels - 1; level > 0; level-- {
+		slotSizePer := 1
+		for i := 0; i < level; i++ {
+			slotSizePer *= blockSize
+		}
+		nodeSizePer := slotSizePer * blockSize
+		nodeCount := (itemCount + nodeSizePer - 1) / nodeSizePer
+		nextChild := uint64(buf.Len() + nodeCount*bytesInIndexBlock)
+		for i := 0; i < itemCount; i += nodeSizePer {
+			countOne := min(blockSize, (itemCount-i+slotSizePer-1)/slotSizePer)
+			binary.Write(buf, binary.LittleEndian, []uint8{0, 0})
+			binary.Write(buf, binary.LittleEndian, uint16(countOne))
+			for j := 0; j < countOne; j++ {
+				buf.Write(key(i + j*slotSizePer))
+				binary.Write(buf, binary.LittleEndian, nextChild)
+				if level == 1 {
+					nextChild += uint64(bytesInLeafBlock)
+				} else {
+					nextChild += uint64(bytesInIndexBlock)
+				}
+			}
+			buf.Write(make([]byte, (blockSize-countOne)*(keySize+8)))
+		}
+	}
+	// Leaf level
+	for i := 0; i < itemCount; i += blockSize {
+		countOne := min(blockSize, itemCount-i)
+		binary.Write(buf, binary.LittleEndian, []uint8{1, 0})
+		binary.Write(buf, binary.LittleEndian, uint16(countOne))
+		for j := i; j < i+countOne; j++ {
+			buf.Write(key(j))
+			binary.Write(buf, binary.LittleEndian, []uint32{uint32(j), uint32(chroms[j].Size)})
+		}
+		buf.Write(make([]byte, (blockSize-countOne)*(keySize+8)))
+	}
+	if itemCount == 0 {
+		binary.Write(buf, binary.LittleEndian, []uint8{1, 0})
+		binary.Write(buf, binary.LittleEndian, uint16(0))
+		buf.Write(make([]byte, blockSize*(keySize+8)))
+	}
+}
+
+// writeCIRTree writes the chromosome-interval R-tree indexing blocks
+func writeCIRTree(buf *bigWigWriter, blocks []bigWigBlock, endFileOffset uint64) {
+	// Levels from leaves to root
+	levels := [][]bigWigBlock{blocks}
+	for len(levels[len(levels)-1]) > bigWigBlockSize {
+		children := levels[len(levels)-1]
+		var parents []bigWigBlock
+		for i := 0; i < len(children); i += bigWigBlockSize {
+			parents = append(parents, boundBlocks(children[i:min(len(children), i+bigWigBlockSize)]))
+		}
+		levels = append(levels, parents)
+	}
+	// Header
+	var bound bigWigBlock
+	if len(blocks) > 0 {
+		bound = boundBlocks(blocks)
+	}
+	binary.Write(buf, binary.LittleEndian, []uint32{cirTreeMagic, bigWigBlockSize})
+	binary.Write(buf, binary.LittleEndian, uint64(len(blocks)))
+	binary.Write(buf, binary.LittleEndian, []uint32{bound.StartChromID, bound.Start, bound.EndChromID, bound.End})
+	binary.Write(buf, binary.LittleEndian, endFileOffset)
+	binary.Write(buf, binary.LittleEndian, []uint32{bigWigItemsPerSlot, 0})
+	// Nodes from root to leaves
+	offset := uint64(buf.Len())
+	for il := len(levels) - 1; il >= 0; il-- {
+		nodes := levels[il]
+		isLeaf := il == 0
+		// Size of nodes at this level and offset of next level
+		var levelSize uint64
+		for i := 0; i < len(nodes); i += bigWigBlockSize {
+			n := min(len(nodes), i+bigWigBlockSize) - i
+			if isLeaf {
+				levelSize += uint64(4 + n*32)
+			} else {
+				levelSize += uint64(4 + n*24)
+			}
+		}
+		nextChild := offset + levelSize
+		for i := 0; i < len(nodes) || (i == 0 && isLeaf); i += bigWigBlockSize {
+			end := min(len(nodes), i+bigWigBlockSize)
+			if isLeaf {
+				binary.Write(buf, binary.LittleEndian, []uint8{1, 0})
+			} else {
+				binary.Write(buf, binary.LittleEndian, []uint8{0, 0})
+			}
+			binary.Write(buf, binary.LittleEndian, uint16(end-i))
+			for j := i; j < end; j++ {
+				n := nodes[j]
+				binary.Write(buf, binary.LittleEndian, []uint32{n.StartChromID, n.Start, n.EndChromID, n.End})
+				if isLeaf {
+					binary.Write(buf, binary.LittleEndian, []uint64{n.Offset, n.Size})
+				} else {
+					// Child node size (level below)
+					nChild := min(len(levels[il-1]), (j+1)*bigWigBlockSize) - j*bigWigBlockSize
+					binary.Write(buf, binary.LittleEndian, nextChild)
+					if il-1 == 0 {
+						nextChild += uint64(4 + nChild*32)
+					} else {
+						nextChild += uint64(4 + nChild*24)
+					}
+				}
+			}
+		}
+		offset += levelSize
+	}
+}
+
+// boundBlocks returns the block covering all blocks (blocks are sorted)
+func boundBlocks(blocks []bigWigBlock) bigWigBlock {
+	b := bigWigBlock{StartChromID: blocks[0].StartChromID, Start: blocks[0].Start, EndChromID: blocks[0].EndChromID, End: blocks[0].End}
+	for _, c := range blocks[1:] {
+		if c.StartChromID < b.StartChromID || (c.StartChromID == b.StartChromID && c.Start < b.Start) {
+			b.StartChromID, b.Start = c.StartChromID, c.Start
+		}
+		if c.EndChromID > b.EndChromID || (c.EndChromID == b.EndChromID && c.End > b.End) {
+			b.EndChromID, b.End = c.EndChromID, c.End
+		}
+	}
+	return b
+}
@@ -0,0 +1,203 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testProfiles returns features B and A with their profiles. Profile of B ends with a non-zero step.
+func testProfiles() []*FeatureExt {
+	return []*FeatureExt{
+		{Feature: &Feature{ID: 0, Name: "B"}, Profile: []float32{3, 3, 3}},
+		{Feature: &Feature{ID: 1, Name: "A"}, Profile: []float32{0, 0, 1, 1, 2, 0}},
+	}
+}
+
+// bptFind returns the ID and size of chromosome name from the B+ tree at offset.
+func bptFind(t *testing.T, bw []byte, offset uint64, name string) (uint32, uint32, bool) {
+	t.Helper()
+	le := binary.LittleEndian
+	if le.Uint32(bw[offset:]) != bptMagic {
+		t.Fatalf("wrong B+ tree magic at %d", offset)
+	}
+	keySize := int(le.Uint32(bw[offset+8:]))
+	key := make([]byte, keySize)
+	copy(key, name)
+	node := offset + 32
+	for {
+		isLeaf := bw[node] == 1
+		count := int(le.Uint16(bw[node+2:]))
+		item := node + 4
+		var child uint64
+		for i := 0; i < count; i++ {
+			k := bw[item : item+uint64(keySize)]
+			if isLeaf {
+				if bytes.Equal(k, key) {
+					return le.Uint32(bw[item+uint64(keySize):]), le.Uint32(bw[item+uint64(keySize)+4:]), true
+				}
+			} else if i == 0 || bytes.Compare(k, key) <= 0 {
+				child = le.Uint64(bw[item+uint64(keySize):])
+			}
+			item += uint64(keySize) + 8
+		}
+		if isLeaf {
+			return 0, 0, false
+		}
+		node = child
+	}
+}
+
+// cirBlocks returns the offset and size of the data blocks of chromosome chromID from the R-tree at offset.
+func cirBlocks(t *testing.T, bw []byte, offset uint64, chromID uint32) (blocks [][2]uint64) {
+	t.Helper()
+	le := binary.LittleEndian
+	if le.Uint32(bw[offset:]) != cirTreeMagic {
+		t.Fatalf("wrong R-tree magic at %d", offset)
+	}
+	var walk func(node uint64)
+	walk = func(node uint64) {
+		isLeaf := bw[node] == 1
+		count := int(le.Uint16(bw[node+2:]))
+		item := node + 4
+		for i := 0; i < count; i++ {
+			startChrom, endChrom := le.Uint32(bw[item:]), le.Uint32(bw[item+8:])
+			if startChrom <= chromID && chromID <= endChrom {
+				if isLeaf {
+					blocks = append(blocks, [2]uint64{le.Uint64(bw[item+16:]), le.Uint64(bw[item+24:])})
+				} else {
+					walk(le.Uint64(bw[item+16:]))
+				}
+			}
+			if isLeaf {
+				item += 32
+			} else {
+				item += 24
+			}
+		}
+	}
+	walk(offset + 48)
+	return
+}
+
+func TestWriteBigWig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.bw")
+	if err := WriteProfiles(testProfiles(), nil, path, "bigwig", false); err != nil {
+		t.Fatal(err)
+	}
+	bw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	// Header
+	if le.Uint32(bw) != bigWigMagic || le.Uint32(bw[len(bw)-4:]) != bigWigMagic {
+		t.Fatal("wrong bigWig magic")
+	}
+	if v := le.Uint16(bw[4:]); v != bigWigVersion {
+		t.Errorf("version: got %d, want %d", v, bigWigVersion)
+	}
+	nZoom := int(le.Uint16(bw[6:]))
+	chromTreeOffset, dataOffset, indexOffset := le.Uint64(bw[8:]), le.Uint64(bw[16:]), le.Uint64(bw[24:])
+	if want := uint64(bigWigHeaderSize + bigWigZoomSize*nZoom + bigWigSummarySize); chromTreeOffset != want {
+		t.Errorf("chromosome tree offset: got %d, want %d", chromTreeOffset, want)
+	}
+	if !(chromTreeOffset < dataOffset && dataOffset < indexOffset && indexOffset < uint64(len(bw))) {
+		t.Fatalf("wrong offsets %d %d %d", chromTreeOffset, dataOffset, indexOffset)
+	}
+	if n := le.Uint64(bw[dataOffset:]); n != 2 {
+		t.Errorf("blocks: got %d, want 2", n)
+	}
+	if summaryOffset := le.Uint64(bw[44:]); summaryOffset != uint64(bigWigHeaderSize+bigWigZoomSize*nZoom) {
+		t.Errorf("summary offset: got %d", summaryOffset)
+	}
+	// Total summary: bases covered
+	if covered := le.Uint64(bw[bigWigHeaderSize+bigWigZoomSize*nZoom:]); covered != 6 {
+		t.Errorf("bases covered: got %d, want 6", covered)
+	}
+	uncompressBufSize := le.Uint32(bw[52:])
+
+	// Steps per chromosome
+	tests := []struct {
+		name      string
+		wantID    uint32
+		wantSize  uint32
+		wantSteps []bigWigItem
+	}{
+		{"A", 0, 6, []bigWigItem{{0, 2, 4, 1}, {0, 4, 5, 2}}},
+		{"B", 1, 3, []bigWigItem{{1, 0, 3, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, size, ok := bptFind(t, bw, chromTreeOffset, tt.name)
+			if !ok || id != tt.wantID || size != tt.wantSize {
+				t.Fatalf("chromosome: got %d %d %v, want %d %d", id, size, ok, tt.wantID, tt.wantSize)
+			}
+			var steps []bigWigItem
+			for _, block := range cirBlocks(t, bw, indexOffset, id) {
+				zr, err := zlib.NewReader(bytes.NewReader(bw[block[0] : block[0]+block[1]]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) > int(uncompressBufSize) {
+					t.Errorf("block size %d larger than %d", len(data), uncompressBufSize)
+				}
+				// Section header: bedGraph type
+				if data[20] != 1 {
+					t.Fatalf("section type: got %d, want 1", data[20])
+				}
+				nItem := int(le.Uint16(data[22:]))
+				items := make([]struct {
+					Start, End uint32
+					Value      float32
+				}, nItem)
+				if err = binary.Read(bytes.NewReader(data[24:]), le, items); err != nil {
+					t.Fatal(err)
+				}
+				for _, it := range items {
+					steps = append(steps, bigWigItem{ChromID: le.Uint32(data), Start: it.Start, End: it.End, Value: it.Value})
+				}
+			}
+			if !reflect.DeepEqual(steps, tt.wantSteps) {
+				t.Errorf("got %v, want %v", steps, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestWriteProfilesBedGraph(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.bedgraph")
+	// Profile of A
+	if err := WriteProfiles(testProfiles()[1:], nil, path, "bedgraph", false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{"A\t2\t4\t1.000000", "A\t4\t5\t2.000000", ""}, "\n")
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err = WriteProfiles(testProfiles(), nil, path, "bigwig+lz4", false); err == nil {
+		t.Error("bigwig+lz4: got no error")
+	}
+}
@@ -12,19 +12,24 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zstd"
 )
 
 type Feature struct {
 	ID     uint32
 	Name   string
+	Group  string
 	Chrom  string
 	Strand int8
 	Coords [][]int
+	CDS    []int
 }
 
 // Length returns the length of feature
@@ -51,27 +56,16 @@ func (f ByChrom) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
 func (f ByChrom) Less(i, j int) bool { return f[i].Chrom < f[j].Chrom }
 
 // OpenFON parses a "Feature Object Notation" string and returns a list of Feature
-func OpenFON(jpath, fonName, fonChrom, fonStrand, fonCoords string) (features []Feature, err error) {
-	var d *json.Decoder
+// If fonGroup is not empty, it is used as FON key for feature group (gene for example).
+// If fonCDSStart and fonCDSEnd are not empty, they are used as FON keys for CDS genomic start and end.
+func OpenFON(jpath, fonName, fonChrom, fonStrand, fonCoords, fonGroup, fonCDSStart, fonCDSEnd string) (features []Feature, err error) {
 	// Open file
-	jfos, err := os.Open(jpath)
+	jfos, err := OpenFile(jpath)
 	if err != nil {
 		return
 	}
 	defer jfos.Close()
-
-	if strings.HasSuffix(jpath, ".zst") {
-		var fzst *zstd.Decoder
-		fzst, err = zstd.NewReader(jfos)
-		if err != nil {
-			return
-		}
-		defer fzst.Close()
-
-		d = json.NewDecoder(fzst)
-	} else {
-		d = json.NewDecoder(jfos)
-	}
+	d := json.NewDecoder(jfos)
 
 	// Parse
 	d.UseNumber()
@@ -106,6 +100,22 @@ func OpenFON(jpath, fonName, fonChrom, fonStrand, fonCoords string) (features []
 			istrand = -1
 		}
 		f := Feature{ID: uint32(i), Name: mf[fonName].(string), Chrom: mf[fonChrom].(string), Strand: istrand}
+		// Group
+		if fonGroup != "" {
+			if group, ok := mf[fonGroup].(string); ok {
+				f.Group = group
+			}
+		}
+		// CDS
+		if fonCDSStart != "" && fonCDSEnd != "" {
+			cdsStart, okStart := mf[fonCDSStart].(json.Number)
+			cdsEnd, okEnd := mf[fonCDSEnd].(json.Number)
+			if okStart && okEnd {
+				s, _ := cdsStart.Int64()
+				e, _ := cdsEnd.Int64()
+				f.CDS = []int{int(s), int(e)}
+			}
+		}
 		// Add coordinates
 		f.Coords = make([][]int, len(mf[fonCoords].([]interface{})))
 		for j, cj := range mf[fonCoords].([]interface{}) {
@@ -147,6 +157,63 @@ func OpenTAB(tpath string, strand int8) (features []Feature, err error) {
 	return
 }
 
+// compressedFile closes the decompressor before the underlying file.
+type compressedFile struct {
+	io.Reader
+	closeFuncs []func() error
+}
+
+func (c *compressedFile) Close() error {
+	var err error
+	for _, fn := range c.closeFuncs {
+		if e := fn(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// OpenFile opens a file for reading, decompressing it if path ends with .gz or .zst
+func OpenFile(fpath string) (io.ReadCloser, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(fpath, ".gz") {
+		fgz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: fgz, closeFuncs: []func() error{fgz.Close, f.Close}}, nil
+	} else if strings.HasSuffix(fpath, ".zst") {
+		fzst, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: fzst, closeFuncs: []func() error{func() error { fzst.Close(); return nil }, f.Close}}, nil
+	}
+	return f, nil
+}
+
+// MergeIntervals returns sorted intervals (0-based [start,end)) with overlapping or adjacent intervals merged
+func MergeIntervals(intervals [][]int) (merged [][]int) {
+	sorted := make([][]int, len(intervals))
+	copy(sorted, intervals)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	for _, iv := range sorted {
+		if n := len(merged); n > 0 && iv[0] <= merged[n-1][1] {
+			if iv[1] > merged[n-1][1] {
+				merged[n-1][1] = iv[1]
+			}
+		} else {
+			merged = append(merged, []int{iv[0], iv[1]})
+		}
+	}
+	return
+}
+
 // IntervalsLength returns the length covered by all intervals (0-based [start,end))
 func IntervalsLength(intervals [][]int) (length int) {
 	for _, iv := range intervals {
@@ -154,3 +221,18 @@ func IntervalsLength(intervals [][]int) (length int) {
 	}
 	return
 }
+
+// StrandTwins returns features followed by a copy of each feature on the opposite strand. Copies are numbered from offset (ID + offset).
+func StrandTwins(features []Feature, offset uint32) ([]Feature, error) {
+	twins := make([]Feature, len(features), 2*len(features))
+	copy(twins, features)
+	for _, feat := range features {
+		if feat.Strand == 0 {
+			return nil, fmt.Errorf("Feature %s has no strand", feat.Name)
+		}
+		feat.ID += offset
+		feat.Strand = -feat.Strand
+		twins = append(twins, feat)
+	}
+	return twins, nil
+}
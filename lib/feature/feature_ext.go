@@ -27,14 +27,36 @@ const (
 	bedGraphPrecision = 0.000001
 )
 
+const (
+	CountUnitRPKM = iota
+	CountUnitTPM
+	CountUnitCPM
+)
+
+var CountUnitNames = []string{"rpkm", "tpm", "cpm"}
+
+// CountMultiEM is the multiplicity of the count column with multi-mapping reads redistributed by expectation-maximization (em)
+const CountMultiEM = 0
+
+// CountName returns the name of the count column of multiplicity cm.
+func CountName(cm int) string {
+	if cm == CountMultiEM {
+		return "em"
+	}
+	return strconv.Itoa(cm)
+}
+
 type FeatureExt struct {
 	*Feature
-	CoordMapper *cmapper.CoordMapper
-	Counts      []float64
-	Profile     []float32
+	CoordMapper  *cmapper.CoordMapper
+	ProfileCDS   []int
+	Counts       []float64
+	RegionCounts []float64
+	Profile      []float32
 }
 
-func ExtendFeatures(features []Feature, countMultis []int, doProfile bool, profileOverhang int) ([]*FeatureExt, error) {
+// ExtendFeatures returns the extended features. CoordMapper is initialized if doProfile or doCoordMapper is true, together with CDS coordinates within the profile (ProfileCDS). Profiles store profileChannels values per position (see SplitChannels).
+func ExtendFeatures(features []Feature, countMultis []int, countUnits []int, doProfile bool, doCoordMapper bool, profileOverhang int, profileChannels int) ([]*FeatureExt, error) {
 	featureExts := make([]*FeatureExt, len(features))
 	for ifeat := 0; ifeat < len(features); ifeat++ {
 		// New
@@ -43,11 +65,11 @@ func ExtendFeatures(features []Feature, countMultis []int, doProfile bool, profi
 			return featureExts, fmt.Errorf("Wrong feature ID")
 		}
 		// Init. count
-		fe.Counts = make([]float64, 1+len(countMultis)*2)
+		fe.Counts = make([]float64, 1+len(countMultis)*(1+len(countUnits)))
 		// Length
 		fe.Counts[0] = float64(IntervalsLength(fe.Coords))
 		// Init. profile
-		if doProfile {
+		if doProfile || doCoordMapper {
 			// Deep-copy
 			coords := make([][]int, len(fe.Coords))
 			for i := 0; i < len(fe.Coords); i++ {
@@ -60,8 +82,18 @@ func ExtendFeatures(features []Feature, countMultis []int, doProfile bool, profi
 			// CoordMapper
 			fe.CoordMapper = &cmapper.CoordMapper{CoordsGenome: coords, Strand: fe.Strand}
 			fe.CoordMapper.Init()
+			// CDS
+			if fe.CDS != nil {
+				cdsStart, okStart := fe.CoordMapper.Genome2Transcript(fe.CDS[0])
+				cdsEnd, okEnd := fe.CoordMapper.Genome2Transcript(fe.CDS[1] - 1)
+				if okStart && okEnd {
+					fe.ProfileCDS = []int{min(cdsStart, cdsEnd), max(cdsStart, cdsEnd) + 1}
+				}
+			}
 			// Profile
-			fe.Profile = make([]float32, fe.CoordMapper.Length)
+			if doProfile {
+				fe.Profile = make([]float32, fe.CoordMapper.Length*profileChannels)
+			}
 		}
 		// Append feature
 		featureExts[ifeat] = &fe
@@ -69,7 +101,104 @@ func ExtendFeatures(features []Feature, countMultis []int, doProfile bool, profi
 	return featureExts, nil
 }
 
-func WriteCounts(featureExts []*FeatureExt, countPath string, countMultis []int, totals []float64, appendOutput bool) error {
+// SplitChannels returns, for each of the nChannel channels, features with the profile of this channel only.
+func SplitChannels(featureExts []*FeatureExt, nChannel int) [][]*FeatureExt {
+	channelExts := make([][]*FeatureExt, nChannel)
+	for ic := 0; ic < nChannel; ic++ {
+		channelExts[ic] = make([]*FeatureExt, len(featureExts))
+		for i, feat := range featureExts {
+			length := len(feat.Profile) / nChannel
+			fc := *feat
+			fc.Profile = feat.Profile[ic*length : (ic+1)*length]
+			channelExts[ic][i] = &fc
+		}
+	}
+	return channelExts
+}
+
+// GroupFeatures builds one extended feature per group of features (gene for example). Features without group are their own group. Group coordinates are the union of the coordinates of the features within each group. It returns the groups and the group ID of each feature.
+func GroupFeatures(featureExts []*FeatureExt, countMultis []int, countUnits []int) ([]*FeatureExt, []uint32) {
+	var groupExts []*FeatureExt
+	groupIDs := make([]uint32, len(featureExts))
+	groupIdx := make(map[string]uint32)
+	groupCoords := make(map[uint32]map[string][][]int)
+	var groupChroms [][]string
+	for ifeat, feat := range featureExts {
+		name := feat.Group
+		if name == "" {
+			name = feat.Name
+		}
+		gid, ok := groupIdx[name]
+		if !ok {
+			gid = uint32(len(groupExts))
+			groupIdx[name] = gid
+			groupCoords[gid] = make(map[string][][]int)
+			groupChroms = append(groupChroms, []string{})
+			groupExts = append(groupExts, &FeatureExt{Feature: &Feature{ID: gid, Name: name, Chrom: feat.Chrom, Strand: feat.Strand}})
+		}
+		if _, ok := groupCoords[gid][feat.Chrom]; !ok {
+			groupChroms[gid] = append(groupChroms[gid], feat.Chrom)
+		}
+		groupCoords[gid][feat.Chrom] = append(groupCoords[gid][feat.Chrom], feat.Coords...)
+		groupIDs[ifeat] = gid
+	}
+	for gid, ge := range groupExts {
+		// Union of coordinates per chromosome
+		for _, chrom := range groupChroms[gid] {
+			ge.Coords = append(ge.Coords, MergeIntervals(groupCoords[uint32(gid)][chrom])...)
+		}
+		// Init. count
+		ge.Counts = make([]float64, 1+len(countMultis)*(1+len(countUnits)))
+		ge.Counts[0] = float64(IntervalsLength(ge.Coords))
+	}
+	return groupExts, groupIDs
+}
+
+// NormalizeCounts fills the normalized count columns (RPKM, TPM or CPM) following each raw count column.
+func NormalizeCounts(featureExts []*FeatureExt, countMultis []int, countUnits []int, totals []float64) {
+	stride := 1 + len(countUnits)
+	for icm := 0; icm < len(countMultis); icm++ {
+		col := 1 + (stride * icm)
+		for iu, unit := range countUnits {
+			ucol := col + 1 + iu
+			switch unit {
+			case CountUnitRPKM:
+				if totals[col] > 0. {
+					for _, feat := range featureExts {
+						feat.Counts[ucol] = feat.Counts[col] * (1000. / feat.Counts[0]) * (1000000. / totals[col])
+					}
+					totals[ucol] = totals[col] * (1000. / totals[0]) * (1000000. / totals[col])
+				}
+			case CountUnitTPM:
+				// Sum of length-normalized counts
+				var rateSum float64
+				for _, feat := range featureExts {
+					if feat.Counts[0] > 0. {
+						rateSum += feat.Counts[col] / feat.Counts[0]
+					}
+				}
+				if rateSum > 0. {
+					for _, feat := range featureExts {
+						if feat.Counts[0] > 0. {
+							feat.Counts[ucol] = (feat.Counts[col] / feat.Counts[0]) * (1000000. / rateSum)
+						}
+					}
+					totals[ucol] = 1000000.
+				}
+			case CountUnitCPM:
+				if totals[col] > 0. {
+					for _, feat := range featureExts {
+						feat.Counts[ucol] = feat.Counts[col] * (1000000. / totals[col])
+					}
+					totals[ucol] = 1000000.
+				}
+			}
+		}
+	}
+}
+
+// WriteCounts writes counts in CSV. If countRegions is true, counts per region (RegionCounts: exonic, intronic and spanning) are added for each multiplicity (except CountMultiEM).
+func WriteCounts(featureExts []*FeatureExt, countPath string, countMultis []int, countUnits []int, totals []float64, countRegions bool, appendOutput bool) error {
 	// Append or Create flag
 	var fg int
 	if appendOutput {
@@ -85,14 +214,27 @@ func WriteCounts(featureExts []*FeatureExt, countPath string, countMultis []int,
 		// Write header
 		f.WriteString("\"name\",\"length\",")
 		for i, cm := range countMultis {
-			fmt.Fprintf(f, "\"count_%d\",\"rpkm_%d\"", cm, cm)
+			fmt.Fprintf(f, "\"count_%s\"", CountName(cm))
+			for _, unit := range countUnits {
+				fmt.Fprintf(f, ",\"%s_%s\"", CountUnitNames[unit], CountName(cm))
+			}
 			if i < ncomma {
 				f.WriteString(",")
 			}
 		}
+		if countRegions {
+			for _, cm := range countMultis {
+				if cm == CountMultiEM {
+					continue
+				}
+				for _, name := range RegionNames {
+					fmt.Fprintf(f, ",\"%s_%d\"", name, cm)
+				}
+			}
+		}
 		f.WriteString("\n")
 		// Totals
-		ncomma = len(countMultis) * 2
+		ncomma = len(totals) - 1
 		f.WriteString("\"total\",")
 		for i, t := range totals {
 			f.WriteString(strconv.FormatFloat(t, 'f', -1, 64))
@@ -100,6 +242,24 @@ func WriteCounts(featureExts []*FeatureExt, countPath string, countMultis []int,
 				f.WriteString(",")
 			}
 		}
+		if countRegions {
+			nRegionMulti := len(countMultis)
+			for _, cm := range countMultis {
+				if cm == CountMultiEM {
+					nRegionMulti--
+				}
+			}
+			regionTotals := make([]float64, nRegionMulti*len(RegionNames))
+			for _, feat := range featureExts {
+				for i, c := range feat.RegionCounts {
+					regionTotals[i] += c
+				}
+			}
+			for _, t := range regionTotals {
+				f.WriteString(",")
+				f.WriteString(strconv.FormatFloat(t, 'f', -1, 64))
+			}
+		}
 		f.WriteString("\n")
 		// Write counts
 		for _, feat := range featureExts {
@@ -110,6 +270,12 @@ func WriteCounts(featureExts []*FeatureExt, countPath string, countMultis []int,
 					f.WriteString(",")
 				}
 			}
+			if countRegions {
+				for _, c := range feat.RegionCounts {
+					f.WriteString(",")
+					f.WriteString(strconv.FormatFloat(c, 'f', -1, 32))
+				}
+			}
 			f.WriteString("\n")
 		}
 		// Close CSV
@@ -133,6 +299,12 @@ func WriteProfiles(featureExts []*FeatureExt, featuresMapping map[string]string,
 		doubleFormat := strings.Split(profileFormat, "+")
 		profileFormat, profileZip = doubleFormat[0], doubleFormat[1]
 	}
+	if profileFormat == "bigwig" && appendOutput {
+		return fmt.Errorf("Append is not available for bigWig profile")
+	}
+	if profileFormat == "bigwig" && profileZip != "" {
+		return fmt.Errorf("Compression is not available for bigWig profile (bigWig data is already compressed)")
+	}
 	// Append or Create flag
 	var fg int
 	if appendOutput {
@@ -208,6 +380,10 @@ func WriteProfiles(featureExts []*FeatureExt, featuresMapping map[string]string,
 					return err
 				}
 			}
+		case "bigwig":
+			if err = WriteBigWig(f, featureExts, featuresMapping); err != nil {
+				return err
+			}
 		case "csv":
 			for _, feat := range featureExts {
 				var name string
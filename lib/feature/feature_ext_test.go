@@ -0,0 +1,101 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCounts(t *testing.T) {
+	units := []int{CountUnitRPKM, CountUnitTPM, CountUnitCPM}
+	tests := []struct {
+		name       string
+		counts     [][]float64
+		total      float64
+		want       [][]float64
+		wantTotals []float64
+	}{
+		{
+			"counts",
+			// Length and raw count of A and B
+			[][]float64{{1000, 10}, {2000, 40}},
+			100,
+			[][]float64{{100000, 1000000. / 3., 100000}, {200000, 2000000. / 3., 400000}},
+			[]float64{1000000. / 3., 1000000, 1000000},
+		},
+		{
+			"no count",
+			[][]float64{{1000, 0}, {2000, 0}},
+			0,
+			[][]float64{{0, 0, 0}, {0, 0, 0}},
+			[]float64{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var featureExts []*FeatureExt
+			totals := make([]float64, 2+len(units))
+			for _, c := range tt.counts {
+				counts := make([]float64, 2+len(units))
+				copy(counts, c)
+				featureExts = append(featureExts, &FeatureExt{Counts: counts})
+				totals[0] += c[0]
+			}
+			totals[1] = tt.total
+			NormalizeCounts(featureExts, []int{1}, units, totals)
+			for i, feat := range featureExts {
+				for iu := range units {
+					if got := feat.Counts[2+iu]; math.Abs(got-tt.want[i][iu]) > 1e-6 {
+						t.Errorf("feature %d %s: got %v, want %v", i, CountUnitNames[units[iu]], got, tt.want[i][iu])
+					}
+				}
+			}
+			for iu := range units {
+				if got := totals[2+iu]; math.Abs(got-tt.wantTotals[iu]) > 1e-6 {
+					t.Errorf("total %s: got %v, want %v", CountUnitNames[units[iu]], got, tt.wantTotals[iu])
+				}
+			}
+		})
+	}
+}
+
+func TestGroupFeatures(t *testing.T) {
+	features := []Feature{
+		{ID: 0, Name: "t1", Group: "g1", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {300, 400}}},
+		{ID: 1, Name: "t2", Group: "g1", Chrom: "chr1", Strand: 1, Coords: [][]int{{150, 250}, {300, 350}}},
+		{ID: 2, Name: "t3", Chrom: "chr1", Strand: 1, Coords: [][]int{{1000, 1100}}},
+	}
+	var featureExts []*FeatureExt
+	for i := range features {
+		featureExts = append(featureExts, &FeatureExt{Feature: &features[i]})
+	}
+	groupExts, groupIDs := GroupFeatures(featureExts, []int{1}, []int{CountUnitRPKM})
+	if want := []uint32{0, 0, 1}; !reflect.DeepEqual(groupIDs, want) {
+		t.Errorf("group IDs: got %v, want %v", groupIDs, want)
+	}
+	tests := []struct {
+		name       string
+		wantCoords [][]int
+		wantLength float64
+	}{
+		{"g1", [][]int{{100, 250}, {300, 400}}, 250},
+		{"t3", [][]int{{1000, 1100}}, 100},
+	}
+	if len(groupExts) != len(tests) {
+		t.Fatalf("got %d groups, want %d", len(groupExts), len(tests))
+	}
+	for i, tt := range tests {
+		ge := groupExts[i]
+		if ge.Name != tt.name || !reflect.DeepEqual(ge.Coords, tt.wantCoords) || ge.Counts[0] != tt.wantLength || len(ge.Counts) != 3 {
+			t.Errorf("got %s %v %v, want %s %v %v", ge.Name, ge.Coords, ge.Counts, tt.name, tt.wantCoords, tt.wantLength)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStrandTwins(t *testing.T) {
+	features := []Feature{
+		{ID: 0, Name: "A", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}}},
+		{ID: 1, Name: "B", Chrom: "chr1", Strand: -1, Coords: [][]int{{300, 400}}},
+	}
+	twins, err := StrandTwins(features, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Feature{
+		features[0],
+		features[1],
+		{ID: 2, Name: "A", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}}},
+		{ID: 3, Name: "B", Chrom: "chr1", Strand: 1, Coords: [][]int{{300, 400}}},
+	}
+	if !reflect.DeepEqual(twins, want) {
+		t.Errorf("got %+v, want %+v", twins, want)
+	}
+	// Input features are unchanged
+	if features[0].ID != 0 || features[0].Strand != 1 {
+		t.Errorf("input feature changed: %+v", features[0])
+	}
+	// Feature without strand
+	if _, err = StrandTwins([]Feature{{Name: "C", Chrom: "chr1", Coords: [][]int{{100, 200}}}}, 1); err == nil {
+		t.Error("got nil error for feature without strand")
+	}
+}
@@ -0,0 +1,218 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type gffRecord struct {
+	Chrom  string
+	Strand int8
+	Coord  []int
+	Groups []string
+	Genes  []string
+	IDs    []string
+}
+
+// parseGTFAttributes parses GTF attributes (key "value"; key "value";)
+func parseGTFAttributes(raw string) map[string][]string {
+	attrs := make(map[string][]string)
+	for _, field := range strings.Split(raw, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, " ", 2)
+		if len(kv) == 2 {
+			attrs[kv[0]] = append(attrs[kv[0]], strings.Trim(strings.TrimSpace(kv[1]), "\""))
+		}
+	}
+	return attrs
+}
+
+// parseGFF3Attributes parses GFF3 attributes (key=value1,value2;key=value)
+func parseGFF3Attributes(raw string) map[string][]string {
+	attrs := make(map[string][]string)
+	for _, field := range strings.Split(raw, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			for _, v := range strings.Split(kv[1], ",") {
+				if uv, err := url.PathUnescape(v); err == nil {
+					v = uv
+				}
+				attrs[kv[0]] = append(attrs[kv[0]], v)
+			}
+		}
+	}
+	return attrs
+}
+
+// OpenGTF parses a GTF file and returns a list of Feature. Records of type featureType (exon for example) are grouped into features using the groupKey attribute (transcript_id for example). Feature group is the gene_id attribute. CDS, start_codon and stop_codon records define the feature CDS. Strand is used for records with undefined strand (. or ?).
+func OpenGTF(gpath, groupKey, featureType string, strand int8) (features []Feature, err error) {
+	return openGFF(gpath, groupKey, featureType, strand, false)
+}
+
+// OpenGFF3 parses a GFF3 file and returns a list of Feature. Records of type featureType (exon for example) are grouped into features using the groupKey attribute (transcript_id for example). If groupKey is missing from a record, it is searched in the record parents. Feature group is the gene_id attribute, searched in the record parents if missing, or the ID of the parent gene. CDS, start_codon and stop_codon records define the feature CDS. Strand is used for records with undefined strand (. or ?).
+func OpenGFF3(gpath, groupKey, featureType string, strand int8) (features []Feature, err error) {
+	return openGFF(gpath, groupKey, featureType, strand, true)
+}
+
+func openGFF(gpath, groupKey, featureType string, strand int8, gff3 bool) (features []Feature, err error) {
+	gfos, err := OpenFile(gpath)
+	if err != nil {
+		return
+	}
+	defer gfos.Close()
+
+	var records, cdsRecords []gffRecord
+	// GFF3 hierarchy: ID to group value(s), to gene(s) and to parent ID(s)
+	idGroups := make(map[string][]string)
+	idGenes := make(map[string][]string)
+	idParents := make(map[string][]string)
+
+	var start, end int
+	gscanner := bufio.NewScanner(gfos)
+	gscanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for gscanner.Scan() {
+		line := gscanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 9 {
+			err = fmt.Errorf("Wrong number of fields in %s: %s", gpath, line)
+			return
+		}
+		// Attributes
+		var attrs map[string][]string
+		if gff3 {
+			attrs = parseGFF3Attributes(fields[8])
+			for _, id := range attrs["ID"] {
+				if v, ok := attrs[groupKey]; ok {
+					idGroups[id] = v
+				}
+				if v, ok := attrs["gene_id"]; ok {
+					idGenes[id] = v
+				} else if strings.HasSuffix(fields[2], "gene") {
+					// gene, ncRNA_gene or pseudogene for example
+					idGenes[id] = []string{id}
+				}
+				if v, ok := attrs["Parent"]; ok {
+					idParents[id] = v
+				}
+			}
+		} else {
+			attrs = parseGTFAttributes(fields[8])
+		}
+		isCDS := fields[2] == "CDS" || fields[2] == "start_codon" || fields[2] == "stop_codon"
+		if fields[2] != featureType && !isCDS {
+			continue
+		}
+		// Coordinates (1-based inclusive to 0-based half-open)
+		if start, err = strconv.Atoi(fields[3]); err != nil {
+			return
+		}
+		if end, err = strconv.Atoi(fields[4]); err != nil {
+			return
+		}
+		r := gffRecord{Chrom: fields[0], Coord: []int{start - 1, end}, Groups: attrs[groupKey], Genes: attrs["gene_id"], Strand: strand}
+		if fields[6] == "+" {
+			r.Strand = 1
+		} else if fields[6] == "-" {
+			r.Strand = -1
+		}
+		if gff3 {
+			r.IDs = attrs["Parent"]
+		}
+		if fields[2] == featureType {
+			records = append(records, r)
+		}
+		if isCDS {
+			cdsRecords = append(cdsRecords, r)
+		}
+	}
+	if err = gscanner.Err(); err != nil {
+		return
+	}
+
+	// Group records into features
+	featureIdx := make(map[string]int)
+	for _, r := range records {
+		groups := r.Groups
+		if len(groups) == 0 {
+			groups = resolveGFFGroups(r.IDs, idGroups, idParents, 0)
+		}
+		genes := r.Genes
+		if len(genes) == 0 {
+			genes = resolveGFFGroups(r.IDs, idGenes, idParents, 0)
+		}
+		for _, g := range groups {
+			if i, ok := featureIdx[g]; ok {
+				if features[i].Chrom != r.Chrom {
+					err = fmt.Errorf("Feature %s found on more than one chromosome (%s and %s)", g, features[i].Chrom, r.Chrom)
+					return
+				}
+				features[i].Coords = append(features[i].Coords, r.Coord)
+			} else {
+				featureIdx[g] = len(features)
+				features = append(features, Feature{ID: uint32(len(features)), Name: g, Chrom: r.Chrom, Strand: r.Strand, Coords: [][]int{r.Coord}})
+				if len(genes) > 0 {
+					features[len(features)-1].Group = genes[0]
+				}
+			}
+		}
+	}
+	// Sort and merge coordinates
+	for i := 0; i < len(features); i++ {
+		features[i].Coords = MergeIntervals(features[i].Coords)
+	}
+	// CDS spanning all CDS records of each feature
+	for _, r := range cdsRecords {
+		groups := r.Groups
+		if len(groups) == 0 {
+			groups = resolveGFFGroups(r.IDs, idGroups, idParents, 0)
+		}
+		for _, g := range groups {
+			if i, ok := featureIdx[g]; ok && features[i].Chrom == r.Chrom {
+				if features[i].CDS == nil {
+					features[i].CDS = []int{r.Coord[0], r.Coord[1]}
+				} else {
+					features[i].CDS[0] = min(features[i].CDS[0], r.Coord[0])
+					features[i].CDS[1] = max(features[i].CDS[1], r.Coord[1])
+				}
+			}
+		}
+	}
+	return
+}
+
+// resolveGFFGroups searches group value(s) from parent ID(s)
+func resolveGFFGroups(ids []string, idGroups, idParents map[string][]string, depth int) (groups []string) {
+	// Guard against cyclic hierarchy
+	if depth > 10 {
+		return
+	}
+	for _, id := range ids {
+		if g, ok := idGroups[id]; ok {
+			groups = append(groups, g...)
+		} else {
+			groups = append(groups, resolveGFFGroups(idParents[id], idGroups, idParents, depth+1)...)
+		}
+	}
+	return
+}
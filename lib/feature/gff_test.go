@@ -0,0 +1,196 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testGTF has transcript t1 (minus strand, exons in transcript order, with CDS) and t2 (plus strand, without CDS) of gene g1.
+const testGTF = `#!genome-build test
+chr1	src	transcript	101	600	.	-	.	gene_id "g1"; transcript_id "t1";
+chr1	src	exon	501	600	.	-	.	gene_id "g1"; transcript_id "t1";
+chr1	src	exon	301	400	.	-	.	gene_id "g1"; transcript_id "t1";
+chr1	src	exon	101	200	.	-	.	gene_id "g1"; transcript_id "t1";
+chr1	src	CDS	301	380	.	-	0	gene_id "g1"; transcript_id "t1";
+chr1	src	CDS	151	200	.	-	2	gene_id "g1"; transcript_id "t1";
+chr1	src	start_codon	378	380	.	-	0	gene_id "g1"; transcript_id "t1";
+chr1	src	stop_codon	148	150	.	-	0	gene_id "g1"; transcript_id "t1";
+chr1	src	exon	1001	1100	.	+	.	gene_id "g1"; transcript_id "t2";
+`
+
+// writeTestGTF writes testGTF to name in dir, compressed with gzip or Zstandard following the name extension.
+func writeTestGTF(t *testing.T, dir string, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.WriteCloser
+	if strings.HasSuffix(name, ".gz") {
+		w = gzip.NewWriter(f)
+	} else if strings.HasSuffix(name, ".zst") {
+		if w, err = zstd.NewWriter(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out io.Writer = f
+	if w != nil {
+		out = w
+	}
+	if _, err = io.WriteString(out, testGTF); err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestOpenGTFStrand(t *testing.T) {
+	tests := []struct {
+		name    string
+		strand  string
+		dstrand int8
+		want    int8
+	}{
+		{"plus", "+", -1, 1},
+		{"minus", "-", 1, -1},
+		{"undefined plus", ".", 1, 1},
+		{"undefined minus", ".", -1, -1},
+		{"unknown", "?", -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.gtf")
+			gtf := "chr1\tsrc\texon\t101\t200\t.\t" + tt.strand + "\t.\tgene_id \"g1\"; transcript_id \"t1\";\n"
+			if err := os.WriteFile(path, []byte(gtf), 0666); err != nil {
+				t.Fatal(err)
+			}
+			features, err := OpenGTF(path, "gene_id", "exon", tt.dstrand)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(features) != 1 {
+				t.Fatalf("got %d features, want 1", len(features))
+			}
+			feat := features[0]
+			if feat.Name != "g1" || feat.Strand != tt.want || feat.Coords[0][0] != 100 || feat.Coords[0][1] != 200 {
+				t.Errorf("got %+v, want g1 on strand %d at [100,200)", feat, tt.want)
+			}
+			trees, err := BuildFeatTrees(features, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(trees["chr1"][tt.want].Get(IntInterval{Start: 150, End: 151})); n != 1 {
+				t.Errorf("got %d intervals at 150, want 1", n)
+			}
+		})
+	}
+}
+
+func TestBuildFeatTreesUndefinedStrand(t *testing.T) {
+	features := []Feature{{ID: 0, Name: "f1", Chrom: "chr1", Strand: 0, Coords: [][]int{{100, 200}}}}
+	if _, err := BuildFeatTrees(features, false); err == nil {
+		t.Error("got nil error for feature without strand")
+	}
+}
+
+func TestOpenGTF(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		groupKey string
+		want     []Feature
+	}{
+		{"transcript", "transcript_id", []Feature{
+			{ID: 0, Name: "t1", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}, {300, 400}, {500, 600}}, CDS: []int{147, 380}, Group: "g1"},
+			{ID: 1, Name: "t2", Chrom: "chr1", Strand: 1, Coords: [][]int{{1000, 1100}}, Group: "g1"},
+		}},
+		// Exons of both transcripts in one feature
+		{"gene", "gene_id", []Feature{
+			{ID: 0, Name: "g1", Chrom: "chr1", Strand: -1, Coords: [][]int{{100, 200}, {300, 400}, {500, 600}, {1000, 1100}}, CDS: []int{147, 380}, Group: "g1"},
+		}},
+	}
+	for _, file := range []string{"f.gtf", "f.gtf.gz", "f.gtf.zst"} {
+		path := writeTestGTF(t, dir, file)
+		for _, tt := range tests {
+			t.Run(file+" "+tt.name, func(t *testing.T) {
+				features, err := OpenGTF(path, tt.groupKey, "exon", 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(features, tt.want) {
+					t.Errorf("got %+v, want %+v", features, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenGFF3(t *testing.T) {
+	gff3 := `##gff-version 3
+chr1	src	gene	101	600	.	+	.	ID=gene1;gene_id=G1
+chr1	src	mRNA	101	600	.	+	.	ID=tx1;Parent=gene1;transcript_id=T1
+chr1	src	mRNA	101	600	.	+	.	ID=tx2;Parent=gene1;transcript_id=T2%2Ca
+chr1	src	exon	101	200	.	+	.	ID=exon1;Parent=tx1,tx2
+chr1	src	exon	301	400	.	+	.	ID=exon2;Parent=tx1
+chr1	src	exon	501	600	.	+	.	ID=exon3;Parent=tx2
+chr1	src	CDS	151	200	.	+	0	ID=cds1;Parent=tx1
+chr1	src	CDS	301	350	.	+	1	ID=cds1;Parent=tx1
+chr1	src	exon	1001	1100	.	-	.	ID=exon4;transcript_id=T3
+chr1	src	ncRNA_gene	2001	2100	.	+	.	ID=gene2
+chr1	src	lnc_RNA	2001	2100	.	+	.	ID=tx4;Parent=gene2;transcript_id=T4
+chr1	src	exon	2001	2100	.	+	.	ID=exon5;Parent=tx4
+`
+	path := filepath.Join(t.TempDir(), "f.gff3")
+	if err := os.WriteFile(path, []byte(gff3), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		groupKey string
+		want     []Feature
+	}{
+		// Group from parent transcripts or from the record. Feature group from gene_id or from the ID of the parent gene.
+		{"transcript", "transcript_id", []Feature{
+			{ID: 0, Name: "T1", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {300, 400}}, CDS: []int{150, 350}, Group: "G1"},
+			{ID: 1, Name: "T2,a", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {500, 600}}, Group: "G1"},
+			{ID: 2, Name: "T3", Chrom: "chr1", Strand: -1, Coords: [][]int{{1000, 1100}}},
+			{ID: 3, Name: "T4", Chrom: "chr1", Strand: 1, Coords: [][]int{{2000, 2100}}, Group: "gene2"},
+		}},
+		// Group from grandparent gene
+		{"gene", "gene_id", []Feature{
+			{ID: 0, Name: "G1", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {300, 400}, {500, 600}}, CDS: []int{150, 350}, Group: "G1"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			features, err := OpenGFF3(path, tt.groupKey, "exon", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(features, tt.want) {
+				t.Errorf("got %+v, want %+v", features, tt.want)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ import (
 type IntInterval struct {
 	Start, End int
 	UID        uintptr
+	Intron     bool
 	Feature    Feature
 }
 
@@ -36,7 +37,7 @@ func (i IntInterval) ID() uintptr {
 }
 
 func (i IntInterval) Range() interval.IntRange {
-	return interval.IntRange{i.Start, i.End}
+	return interval.IntRange{Start: i.Start, End: i.End}
 }
 
 func (i IntInterval) String() string {
@@ -0,0 +1,108 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/biogo/hts/sam"
+)
+
+// Junction is a splice junction (intron from Start to End in genomic coordinates, end excluded) seen in reads overlapping feature ID
+type Junction struct {
+	ID    uint32
+	Start int
+	End   int
+}
+
+// ReadJunctions appends the junctions (skipped regions) of the read alignment to junctions.
+func ReadJunctions(r *sam.Record, junctions [][2]int) [][2]int {
+	iRef := r.Start()
+	for _, co := range r.Cigar {
+		if co.Type() == sam.CigarSkipped {
+			junctions = append(junctions, [2]int{iRef, iRef + co.Len()})
+		}
+		if co.Type().Consumes().Reference == 1 {
+			iRef += co.Len()
+		}
+	}
+	return junctions
+}
+
+// WriteJunctions writes, for each feature, the counts of annotated junctions (between consecutive coordinates, including junctions without reads) followed by the counts of unannotated junctions in CSV.
+func WriteJunctions(featureExts []*FeatureExt, junctionCounts map[Junction][]float64, junctionPath string, countMultis []int, appendOutput bool) error {
+	// Append or Create flag
+	var fg int
+	if appendOutput {
+		fg = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	} else {
+		fg = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(junctionPath, fg, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Junctions per feature
+	featureJunctions := make(map[uint32][]Junction)
+	for j := range junctionCounts {
+		featureJunctions[j.ID] = append(featureJunctions[j.ID], j)
+	}
+	// Write header
+	f.WriteString("\"name\",\"chrom\",\"start\",\"end\",\"strand\",\"annotated\"")
+	for _, cm := range countMultis {
+		fmt.Fprintf(f, ",\"count_%d\"", cm)
+	}
+	f.WriteString("\n")
+	// Write counts
+	zeros := make([]float64, len(countMultis))
+	for _, feat := range featureExts {
+		strand := "+"
+		if feat.Strand == -1 {
+			strand = "-"
+		}
+		writeRow := func(j Junction, annotated bool) {
+			counts, ok := junctionCounts[j]
+			if !ok {
+				counts = zeros
+			}
+			fmt.Fprintf(f, "\"%s\",\"%s\",%d,%d,\"%s\",%t", feat.Name, feat.Chrom, j.Start, j.End, strand, annotated)
+			for _, c := range counts {
+				f.WriteString(",")
+				f.WriteString(strconv.FormatFloat(c, 'f', -1, 64))
+			}
+			f.WriteString("\n")
+		}
+		// Annotated
+		annotated := make(map[Junction]bool)
+		coords := MergeIntervals(feat.Coords)
+		for i := 1; i < len(coords); i++ {
+			j := Junction{ID: feat.ID, Start: coords[i-1][1], End: coords[i][0]}
+			annotated[j] = true
+			writeRow(j, true)
+		}
+		// Unannotated
+		junctions := featureJunctions[feat.ID]
+		sort.Slice(junctions, func(a, b int) bool {
+			if junctions[a].Start == junctions[b].Start {
+				return junctions[a].End < junctions[b].End
+			}
+			return junctions[a].Start < junctions[b].Start
+		})
+		for _, j := range junctions {
+			if !annotated[j] {
+				writeRow(j, false)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJunctions(t *testing.T) {
+	tests := []struct {
+		name string
+		read string
+		want [][2]int
+	}{
+		{"unspliced", "r1 0 chr1 101 255 20M * 0 0 " + strings.Repeat("A", 20) + " *", nil},
+		// Deletion and soft-clip are not junctions
+		{"spliced", "r1 0 chr1 101 255 2S10M100N5M2D5M50N3M * 0 0 " + strings.Repeat("A", 25) + " *", [][2]int{{110, 210}, {222, 272}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReadJunctions(testRecords(t, tt.read)[0], nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJunctions(t *testing.T) {
+	featureExts := []*FeatureExt{
+		{Feature: &Feature{ID: 0, Name: "A", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {300, 400}, {500, 600}}}},
+		{Feature: &Feature{ID: 1, Name: "B", Chrom: "chr1", Strand: -1, Coords: [][]int{{1000, 1100}, {1200, 1300}}}},
+	}
+	junctionCounts := map[Junction][]float64{
+		{ID: 0, Start: 200, End: 300}: {2, 2.5},
+		{ID: 0, Start: 250, End: 300}: {1, 1},
+		{ID: 0, Start: 150, End: 300}: {0, 0.5},
+	}
+	path := filepath.Join(t.TempDir(), "junctions.csv")
+	if err := WriteJunctions(featureExts, junctionCounts, path, []int{1, 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Annotated junctions first (with or without reads), then unannotated junctions sorted by position
+	want := strings.Join([]string{
+		`"name","chrom","start","end","strand","annotated","count_1","count_2"`,
+		`"A","chr1",200,300,"+",true,2,2.5`,
+		`"A","chr1",400,500,"+",true,0,0`,
+		`"A","chr1",150,300,"+",false,0,0.5`,
+		`"A","chr1",250,300,"+",false,1,1`,
+		`"B","chr1",1100,1200,"-",true,0,0`,
+		"",
+	}, "\n")
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
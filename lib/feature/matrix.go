@@ -0,0 +1,139 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CellUMI is a UMI of a cell (barcode) found in read(s) assigned to feature ID
+type CellUMI struct {
+	ID      uint32
+	Barcode string
+	UMI     string
+}
+
+// OpenBarcodes returns the cell barcodes (first column) listed in bpath.
+func OpenBarcodes(bpath string) (map[string]bool, error) {
+	barcodes := make(map[string]bool)
+	f, err := OpenFile(bpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		barcodes[strings.Fields(line)[0]] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return barcodes, nil
+}
+
+// WriteMatrix writes the number of UMIs per feature and cell in Matrix Market format (matrix.mtx with features in rows and cells in columns) with features.tsv and barcodes.tsv in directory mpath. Cells are sorted by barcode.
+func WriteMatrix(featureExts []*FeatureExt, umis map[CellUMI]bool, mpath string) error {
+	if err := os.MkdirAll(mpath, 0777); err != nil {
+		return err
+	}
+	// Row of features
+	rows := make(map[uint32]int)
+	for i, feat := range featureExts {
+		rows[feat.ID] = i + 1
+	}
+	// Count UMIs per feature and cell
+	counts := make(map[int]map[string]int)
+	cells := make(map[string]bool)
+	for u := range umis {
+		row, ok := rows[u.ID]
+		if !ok {
+			continue
+		}
+		if _, ok := counts[row]; !ok {
+			counts[row] = make(map[string]int)
+		}
+		counts[row][u.Barcode]++
+		cells[u.Barcode] = true
+	}
+	barcodes := make([]string, 0, len(cells))
+	for barcode := range cells {
+		barcodes = append(barcodes, barcode)
+	}
+	sort.Strings(barcodes)
+	columns := make(map[string]int)
+	for i, barcode := range barcodes {
+		columns[barcode] = i + 1
+	}
+	// Features
+	f, err := os.Create(filepath.Join(mpath, "features.tsv"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, feat := range featureExts {
+		group := feat.Group
+		if group == "" {
+			group = feat.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\tGene Expression\n", feat.Name, group)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	f.Close()
+	// Barcodes
+	f, err = os.Create(filepath.Join(mpath, "barcodes.tsv"))
+	if err != nil {
+		return err
+	}
+	w = bufio.NewWriter(f)
+	for _, barcode := range barcodes {
+		fmt.Fprintln(w, barcode)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	f.Close()
+	// Matrix
+	f, err = os.Create(filepath.Join(mpath, "matrix.mtx"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var nEntry int
+	for _, cc := range counts {
+		nEntry += len(cc)
+	}
+	w = bufio.NewWriter(f)
+	fmt.Fprintf(w, "%%%%MatrixMarket matrix coordinate integer general\n%%\n%d %d %d\n", len(featureExts), len(barcodes), nEntry)
+	for row := 1; row <= len(featureExts); row++ {
+		cc, ok := counts[row]
+		if !ok {
+			continue
+		}
+		rowBarcodes := make([]string, 0, len(cc))
+		for barcode := range cc {
+			rowBarcodes = append(rowBarcodes, barcode)
+		}
+		sort.Strings(rowBarcodes)
+		for _, barcode := range rowBarcodes {
+			fmt.Fprintf(w, "%d %d %d\n", row, columns[barcode], cc[barcode])
+		}
+	}
+	return w.Flush()
+}
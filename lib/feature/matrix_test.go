@@ -0,0 +1,68 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenBarcodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "barcodes.tsv")
+	if err := os.WriteFile(path, []byte("# barcodes\nAAAC\tcell1\n\nCCCG\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	barcodes, err := OpenBarcodes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"AAAC": true, "CCCG": true}; !reflect.DeepEqual(barcodes, want) {
+		t.Errorf("got %v, want %v", barcodes, want)
+	}
+}
+
+func TestWriteMatrix(t *testing.T) {
+	featureExts := []*FeatureExt{
+		{Feature: &Feature{ID: 0, Name: "t1", Group: "g1"}},
+		{Feature: &Feature{ID: 1, Name: "t2"}},
+	}
+	umis := map[CellUMI]bool{
+		{ID: 1, Barcode: "CCCG", UMI: "AA"}: true,
+		{ID: 1, Barcode: "CCCG", UMI: "GG"}: true,
+		// Feature not written
+		{ID: 5, Barcode: "AAAC", UMI: "AA"}: true,
+	}
+	dir := filepath.Join(t.TempDir(), "matrix")
+	if err := WriteMatrix(featureExts, umis, dir); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"features.tsv", []string{"t1\tg1\tGene Expression", "t2\tt2\tGene Expression"}},
+		{"barcodes.tsv", []string{"CCCG"}},
+		// 2 features, 1 cell and 1 entry: 2 UMIs of t2 in CCCG
+		{"matrix.mtx", []string{"%%MatrixMarket matrix coordinate integer general", "%", "2 1 1", "2 1 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := os.ReadFile(filepath.Join(dir, tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(tt.want, "\n") + "\n"; string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"github.com/biogo/hts/sam"
+	"github.com/biogo/store/interval"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+)
+
+const (
+	OverlapModeAll = iota
+	OverlapModeUnion
+	OverlapModeIntersectionStrict
+	OverlapModeIntersectionNonempty
+	OverlapModeFractional
+	OverlapModeDrop
+)
+
+// ResolveOverlap selects the feature(s) the read(s) are assigned to following overlapMode:
+//   - all: every feature with at least minOverlap overlap,
+//   - union, intersection-strict and intersection-nonempty: as in htseq-count, read(s) overlapping more than one feature are ambiguous and discarded (features overlapped by less than minOverlap are ignored),
+//   - fractional: every feature with at least minOverlap overlap, each receiving a fraction of the read(s),
+//   - drop: read(s) overlapping more than one feature are ambiguous and discarded, including features overlapped by less than minOverlap.
+//
+// If intronic is true, the read(s) only overlap feature introns and Length of featuresOverlap is the overlap with introns.
+//
+// It returns the selected features, the fraction of the read(s) counted for each feature and if the read(s) were ambiguous.
+func ResolveOverlap(areads []*sam.Record, libraryR1Strand int8, trees map[string]map[int8]*interval.IntTree, featuresOverlap map[uint32]FeatureOverlap, intronic bool, overlapMode int, minOverlap int) (map[uint32]FeatureOverlap, float32, bool) {
+	var nCandidate int
+	switch overlapMode {
+	case OverlapModeUnion, OverlapModeIntersectionStrict, OverlapModeIntersectionNonempty:
+		// Features overlapped by less than minOverlap
+		for featID, overlap := range featuresOverlap {
+			if overlap.Length == 0 || overlap.Length < minOverlap {
+				delete(featuresOverlap, featID)
+			}
+		}
+		// Length (aligned bases) the features must cover
+		var targetLength int
+		if overlapMode == OverlapModeIntersectionStrict {
+			for _, aread := range areads {
+				for _, block := range esam.AlignedBlocks(aread) {
+					targetLength += block[1] - block[0]
+				}
+			}
+		} else if overlapMode == OverlapModeIntersectionNonempty {
+			targetLength = coveredLength(areads, libraryR1Strand, trees, featuresOverlap, intronic)
+		}
+		// Candidate features
+		for featID, overlap := range featuresOverlap {
+			if overlapMode == OverlapModeUnion || overlap.Length >= targetLength {
+				nCandidate++
+			} else {
+				delete(featuresOverlap, featID)
+			}
+		}
+		if nCandidate > 1 {
+			return nil, 0., true
+		}
+		return featuresOverlap, 1., false
+	case OverlapModeDrop:
+		for _, overlap := range featuresOverlap {
+			if overlap.Length > 0 {
+				nCandidate++
+			}
+		}
+		if nCandidate > 1 {
+			return nil, 0., true
+		}
+		return featuresOverlap, 1., false
+	default:
+		for _, overlap := range featuresOverlap {
+			if overlap.Length >= minOverlap {
+				nCandidate++
+			}
+		}
+		if nCandidate > 1 {
+			if overlapMode == OverlapModeFractional {
+				return featuresOverlap, 1. / float32(nCandidate), true
+			}
+			return featuresOverlap, 1., true
+		}
+		return featuresOverlap, 1., false
+	}
+}
+
+// coveredLength returns the number of aligned bases of read(s) overlapping at least one of the features (intervals or introns if intronic is true)
+func coveredLength(areads []*sam.Record, libraryR1Strand int8, trees map[string]map[int8]*interval.IntTree, featuresOverlap map[uint32]FeatureOverlap, intronic bool) (length int) {
+	areadStrands := readStrands(areads, libraryR1Strand)
+	for _, aread := range areads {
+		tree, ok := trees[aread.Ref.Name()]
+		if !ok {
+			continue
+		}
+		for _, block := range esam.AlignedBlocks(aread) {
+			covered := make([]bool, block[1]-block[0])
+			for _, rstrand := range areadStrands {
+				for _, iv := range tree[rstrand].Get(IntInterval{Start: block[0], End: block[1]}) {
+					if iv.(IntInterval).Intron != intronic {
+						continue
+					}
+					if _, ok := featuresOverlap[iv.(IntInterval).Feature.ID]; !ok {
+						continue
+					}
+					for p := max(block[0], iv.Range().Start); p < min(block[1], iv.Range().End); p++ {
+						covered[p-block[0]] = true
+					}
+				}
+			}
+			for _, c := range covered {
+				if c {
+					length++
+				}
+			}
+		}
+	}
+	return
+}
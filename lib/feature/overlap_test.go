@@ -0,0 +1,119 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+)
+
+// testRecords returns the alignments of a read given as SAM lines on chr1.
+func testRecords(t *testing.T, lines ...string) []*sam.Record {
+	t.Helper()
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*sam.Record
+	for _, line := range lines {
+		var r sam.Record
+		if err := r.UnmarshalSAM(header, []byte(strings.Join(strings.Fields(line), "\t"))); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &r)
+	}
+	return records
+}
+
+// testFeatures returns features A [100,200), B [195,300) and C with exons [400,450) and [480,500), all on + strand.
+func testFeatures() []Feature {
+	return []Feature{
+		{ID: 0, Name: "A", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}}},
+		{ID: 1, Name: "B", Chrom: "chr1", Strand: 1, Coords: [][]int{{195, 300}}},
+		{ID: 2, Name: "C", Chrom: "chr1", Strand: 1, Coords: [][]int{{400, 450}, {480, 500}}},
+	}
+}
+
+func TestResolveOverlap(t *testing.T) {
+	// Read at [150,200): 50 bases on A and 5 bases on B
+	readAB := "r1 0 chr1 151 255 50M * 0 0 " + strings.Repeat("A", 50) + " *"
+	// Read at [440,460): 10 bases on C exon and 10 bases on C intron
+	readC := "r2 0 chr1 441 255 20M * 0 0 " + strings.Repeat("A", 20) + " *"
+	// Read at [455,475): 20 bases on C intron
+	readCIntron := "r4 0 chr1 456 255 20M * 0 0 " + strings.Repeat("A", 20) + " *"
+	// Read at [190,260): 10 bases on A and 65 bases on B
+	readBA := "r3 0 chr1 191 255 70M * 0 0 " + strings.Repeat("A", 70) + " *"
+	tests := []struct {
+		name          string
+		read          string
+		withIntrons   bool
+		intronic      bool
+		overlapMode   int
+		minOverlap    int
+		wantIDs       []uint32
+		wantFraction  float32
+		wantAmbiguous bool
+	}{
+		{"all min10", readAB, false, false, OverlapModeAll, 10, []uint32{0}, 1., false},
+		{"all min1", readAB, false, false, OverlapModeAll, 1, []uint32{0, 1}, 1., true},
+		{"union min10", readAB, false, false, OverlapModeUnion, 10, []uint32{0}, 1., false},
+		{"union min1", readAB, false, false, OverlapModeUnion, 1, nil, 0., true},
+		{"union min1 two features", readBA, false, false, OverlapModeUnion, 1, nil, 0., true},
+		{"intersection-strict min1", readAB, false, false, OverlapModeIntersectionStrict, 1, []uint32{0}, 1., false},
+		{"intersection-strict min10", readBA, false, false, OverlapModeIntersectionStrict, 10, nil, 1., false},
+		{"intersection-nonempty min10", readAB, false, false, OverlapModeIntersectionNonempty, 10, []uint32{0}, 1., false},
+		{"intersection-nonempty min1", readAB, false, false, OverlapModeIntersectionNonempty, 1, []uint32{0}, 1., false},
+		{"intersection-nonempty min1 two features", readBA, false, false, OverlapModeIntersectionNonempty, 1, nil, 1., false},
+		{"intersection-nonempty min20", readBA, false, false, OverlapModeIntersectionNonempty, 20, []uint32{1}, 1., false},
+		{"intersection-nonempty intron", readC, true, false, OverlapModeIntersectionNonempty, 1, []uint32{2}, 1., false},
+		{"intersection-nonempty intronic", readCIntron, true, true, OverlapModeIntersectionNonempty, 10, []uint32{2}, 1., false},
+		{"fractional min10", readAB, false, false, OverlapModeFractional, 10, []uint32{0}, 1., false},
+		{"fractional min1", readAB, false, false, OverlapModeFractional, 1, []uint32{0, 1}, 0.5, true},
+		{"drop min10", readAB, false, false, OverlapModeDrop, 10, nil, 0., true},
+		{"drop min1", readAB, false, false, OverlapModeDrop, 1, nil, 0., true},
+		{"drop one feature", readC, true, false, OverlapModeDrop, 1, []uint32{2}, 1., false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trees, err := BuildFeatTrees(testFeatures(), tt.withIntrons)
+			if err != nil {
+				t.Fatal(err)
+			}
+			areads := testRecords(t, tt.read)
+			featuresOverlap := OverlapFeatureRead(areads, 0, trees, false)
+			// Intronic read(s) are assigned using their intron overlap
+			if tt.intronic {
+				for featID, overlap := range featuresOverlap {
+					overlap.Length = overlap.IntronLength
+					featuresOverlap[featID] = overlap
+				}
+			}
+			featuresOverlap, fraction, ambiguous := ResolveOverlap(areads, 0, trees, featuresOverlap, tt.intronic, tt.overlapMode, tt.minOverlap)
+			// Features counted (overlap of at least minOverlap)
+			var ids []uint32
+			for featID, overlap := range featuresOverlap {
+				if overlap.Length >= tt.minOverlap {
+					ids = append(ids, featID)
+				}
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			if !reflect.DeepEqual(ids, tt.wantIDs) || fraction != tt.wantFraction || ambiguous != tt.wantAmbiguous {
+				t.Errorf("got %v %v %v, want %v %v %v", ids, fraction, ambiguous, tt.wantIDs, tt.wantFraction, tt.wantAmbiguous)
+			}
+		})
+	}
+}
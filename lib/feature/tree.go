@@ -9,23 +9,53 @@
 package feature
 
 import (
+	"fmt"
+
 	"github.com/biogo/hts/sam"
 	"github.com/biogo/store/interval"
 
 	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
 )
 
+const (
+	RegionExonic = iota
+	RegionIntronic
+	RegionSpanning
+)
+
+var RegionNames = []string{"exonic", "intronic", "spanning"}
+
+// FeatureOverlap is the overlap of read(s) with a feature. Length is the overlap with the feature intervals (i.e. exons) and IntronLength the overlap with the feature introns (if added to the trees).
 type FeatureOverlap struct {
-	Length int
-	Read   []bool
+	Length       int
+	IntronLength int
+	Read         []bool
+}
+
+// Region returns if the read(s) overlap only exons, only introns or both (spanning).
+func (fo FeatureOverlap) Region() int {
+	if fo.IntronLength == 0 {
+		return RegionExonic
+	} else if fo.Length == 0 {
+		return RegionIntronic
+	}
+	return RegionSpanning
 }
 
-// BuildFeatTrees builds a tree of features: each interval (i.e. exon) of each feature is added to the tree.
-func BuildFeatTrees(features []Feature) (trees map[string]map[int8]*interval.IntTree, err error) {
+// BuildFeatTrees builds a tree of features: each interval (i.e. exon) of each feature is added to the tree. If withIntrons is true, introns (gaps between intervals) are also added, tagged as intron.
+func BuildFeatTrees(features []Feature, withIntrons bool) (trees map[string]map[int8]*interval.IntTree, err error) {
 	trees = make(map[string]map[int8]*interval.IntTree)
 	icoord := 0
 	for _, feat := range features {
-		for _, coord := range feat.Coords {
+		coords := feat.Coords
+		var introns [][]int
+		if withIntrons {
+			merged := MergeIntervals(feat.Coords)
+			for i := 1; i < len(merged); i++ {
+				introns = append(introns, []int{merged[i-1][1], merged[i][0]})
+			}
+		}
+		for i, coord := range append(coords[:len(coords):len(coords)], introns...) {
 			// New tree for unseen chromosome
 			if _, ok := trees[feat.Chrom]; !ok {
 				trees[feat.Chrom] = make(map[int8]*interval.IntTree)
@@ -33,9 +63,14 @@ func BuildFeatTrees(features []Feature) (trees map[string]map[int8]*interval.Int
 				trees[feat.Chrom][-1] = &interval.IntTree{}
 			}
 			// Creating new interval
-			iv := IntInterval{Start: coord[0], End: coord[1], UID: uintptr(icoord), Feature: Feature{ID: feat.ID, Name: feat.Name, Strand: feat.Strand}}
+			iv := IntInterval{Start: coord[0], End: coord[1], UID: uintptr(icoord), Intron: i >= len(coords), Feature: Feature{ID: feat.ID, Name: feat.Name, Strand: feat.Strand, Coords: feat.Coords}}
 			// Inserting interval
-			err = trees[feat.Chrom][feat.Strand].Insert(iv, false)
+			tree, ok := trees[feat.Chrom][feat.Strand]
+			if !ok {
+				err = fmt.Errorf("Undefined strand %d for feature %s", feat.Strand, feat.Name)
+				return
+			}
+			err = tree.Insert(iv, false)
 			if err != nil {
 				return
 			}
@@ -49,34 +84,94 @@ func BuildFeatTrees(features []Feature) (trees map[string]map[int8]*interval.Int
 	return
 }
 
-func OverlapFeatureRead(areads []*sam.Record, libraryR1Strand int8, trees map[string]map[int8]*interval.IntTree) map[uint32]FeatureOverlap {
-	// Read strand corrected for library strand
-	var areadStrands []int8
+// TreeRegions returns the genomic regions (0-based [start,end)) covered by the intervals of the trees per chromosome, merged and sorted.
+func TreeRegions(trees map[string]map[int8]*interval.IntTree) map[string][][]int {
+	regions := make(map[string][][]int)
+	for chrom, strandTrees := range trees {
+		var intervals [][]int
+		for _, tree := range strandTrees {
+			tree.Do(func(e interval.IntInterface) bool {
+				r := e.Range()
+				intervals = append(intervals, []int{r.Start, r.End})
+				return false
+			})
+		}
+		if len(intervals) > 0 {
+			regions[chrom] = MergeIntervals(intervals)
+		}
+	}
+	return regions
+}
+
+// readStrands returns the feature strand(s) to search for read(s) corrected for library strand
+func readStrands(areads []*sam.Record, libraryR1Strand int8) []int8 {
 	apairR1Strand := areads[0].Strand()
-	if libraryR1Strand == 0 {
-		areadStrands = []int8{-1, 1}
-	} else if libraryR1Strand == 1 {
-		areadStrands = []int8{apairR1Strand}
+	if libraryR1Strand == 1 {
+		return []int8{apairR1Strand}
 	} else if libraryR1Strand == -1 {
-		areadStrands = []int8{apairR1Strand * -1}
-	}
-	// Aligned-read intervals
-	var areadIntervals []IntInterval
-	for _, aread := range areads {
-		areadIntervals = append(areadIntervals, IntInterval{Start: aread.Start(), End: aread.End()})
+		return []int8{apairR1Strand * -1}
 	}
+	return []int8{-1, 1}
+}
+
+// OverlapFeatureRead returns the features overlapping the aligned blocks of the read(s). If junctionCompatible is true, features must contain an intron matching each junction (skipped region) of the read(s) overlapping them.
+func OverlapFeatureRead(areads []*sam.Record, libraryR1Strand int8, trees map[string]map[int8]*interval.IntTree, junctionCompatible bool) map[uint32]FeatureOverlap {
+	// Read strand corrected for library strand
+	areadStrands := readStrands(areads, libraryR1Strand)
 	// Overlapping features
 	featuresOverlap := make(map[uint32]FeatureOverlap)
+	var featuresCoords map[uint32][][]int
+	if junctionCompatible {
+		featuresCoords = make(map[uint32][][]int)
+	}
+	var seen []uintptr
 	for i := 0; i < len(areads); i++ {
+		tree, ok := trees[areads[i].Ref.Name()]
+		if !ok {
+			continue
+		}
+		// Aligned-read intervals
+		blocks := esam.AlignedBlocks(areads[i])
+		seen = seen[:0]
 		for _, rstrand := range areadStrands {
-			if tree, ok := trees[areads[i].Ref.Name()]; ok {
-				for _, iv := range tree[rstrand].Get(areadIntervals[i]) {
+			for _, block := range blocks {
+				for _, iv := range tree[rstrand].Get(IntInterval{Start: block[0], End: block[1]}) {
+					// Interval already found with another block
+					isSeen := false
+					for _, uid := range seen {
+						if uid == iv.ID() {
+							isSeen = true
+							break
+						}
+					}
+					if isSeen {
+						continue
+					}
+					seen = append(seen, iv.ID())
+					// Add intron overlap
+					if iv.(IntInterval).Intron {
+						fo, ok := featuresOverlap[iv.(IntInterval).Feature.ID]
+						if !ok {
+							fo = FeatureOverlap{Read: make([]bool, len(areads))}
+							if junctionCompatible {
+								featuresCoords[iv.(IntInterval).Feature.ID] = iv.(IntInterval).Feature.Coords
+							}
+						}
+						fo.IntronLength += esam.Overlap(areads[i], iv.Range().Start, iv.Range().End)
+						featuresOverlap[iv.(IntInterval).Feature.ID] = fo
+						continue
+					}
+					// Add overlap
 					if fo, ok := featuresOverlap[iv.(IntInterval).Feature.ID]; ok {
 						fo.Length += esam.Overlap(areads[i], iv.Range().Start, iv.Range().End)
 						fo.Read[i] = true
+						featuresOverlap[iv.(IntInterval).Feature.ID] = fo
 					} else {
 						featuresOverlap[iv.(IntInterval).Feature.ID] = FeatureOverlap{Length: esam.Overlap(areads[i], iv.Range().Start, iv.Range().End), Read: make([]bool, len(areads))}
 						featuresOverlap[iv.(IntInterval).Feature.ID].Read[i] = true
+						if junctionCompatible {
+							featuresCoords[iv.(IntInterval).Feature.ID] = iv.(IntInterval).Feature.Coords
+						}
 					}
 					//if Debug {
 					//	fmt.Println("Overlap", "read"+strconv.Itoa(i+1), iv.(IntInterval).Feature.Name, iv.(IntInterval).UID, iv.Range().Start, iv.Range().End, Overlap(areads[i], iv.Range().Start, iv.Range().End))
@@ -85,5 +180,37 @@ func OverlapFeatureRead(areads []*sam.Record, libraryR1Strand int8, trees map[st
 			}
 		}
 	}
+	// Remove features with intron(s) not matching read junction(s)
+	if junctionCompatible {
+		for i := 0; i < len(areads); i++ {
+			junctions := esam.Junctions(areads[i])
+			if len(junctions) == 0 {
+				continue
+			}
+			for featID, fo := range featuresOverlap {
+				if fo.Read[i] && !JunctionsCompatible(junctions, featuresCoords[featID]) {
+					delete(featuresOverlap, featID)
+				}
+			}
+		}
+	}
 	return featuresOverlap
 }
+
+// JunctionsCompatible returns true if each junction (0-based [start,end)) matches an intron between consecutive coordinates (coordinates are sorted and merged, e.g. exons of minus strand features in transcript order)
+func JunctionsCompatible(junctions [][]int, coords [][]int) bool {
+	merged := MergeIntervals(coords)
+	for _, junction := range junctions {
+		found := false
+		for k := 0; k < len(merged)-1; k++ {
+			if merged[k][1] == junction[0] && merged[k+1][0] == junction[1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
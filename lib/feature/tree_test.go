@@ -0,0 +1,91 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package feature
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestJunctionsCompatible(t *testing.T) {
+	tests := []struct {
+		name      string
+		junctions [][]int
+		coords    [][]int
+		want      bool
+	}{
+		{"no junction", nil, [][]int{{100, 200}}, true},
+		{"one junction", [][]int{{200, 300}}, [][]int{{100, 200}, {300, 400}, {500, 600}}, true},
+		{"two junctions", [][]int{{200, 300}, {400, 500}}, [][]int{{100, 200}, {300, 400}, {500, 600}}, true},
+		// Junction skipping an exon
+		{"exon skipping", [][]int{{200, 500}}, [][]int{{100, 200}, {300, 400}, {500, 600}}, false},
+		{"shifted junction", [][]int{{205, 300}}, [][]int{{100, 200}, {300, 400}}, false},
+		{"unspliced feature", [][]int{{200, 300}}, [][]int{{100, 400}}, false},
+		// Exons of minus strand feature in transcript order
+		{"descending coords", [][]int{{200, 300}, {400, 500}}, [][]int{{500, 600}, {300, 400}, {100, 200}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JunctionsCompatible(tt.junctions, tt.coords); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlapFeatureRead(t *testing.T) {
+	// A with exons [100,200) and [300,400), B (minus strand, exons in transcript order) with exons [500,600) and [700,800), C with exon [220,280) in intron of A and D [100,400) unspliced
+	features := []Feature{
+		{ID: 0, Name: "A", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 200}, {300, 400}}},
+		{ID: 1, Name: "B", Chrom: "chr1", Strand: -1, Coords: [][]int{{700, 800}, {500, 600}}},
+		{ID: 2, Name: "C", Chrom: "chr1", Strand: 1, Coords: [][]int{{220, 280}}},
+		{ID: 3, Name: "D", Chrom: "chr1", Strand: 1, Coords: [][]int{{100, 400}}},
+	}
+	trees, err := BuildFeatTrees(features, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := strings.Repeat("A", 20)
+	tests := []struct {
+		name       string
+		read       string
+		junction   bool
+		wantIDs    []uint32
+		wantLength []int
+	}{
+		{"unspliced", "r1 0 chr1 181 255 20M * 0 0 " + seq + " *", false, []uint32{0, 3}, []int{20, 20}},
+		// N-gap spanning C: no overlap with C
+		{"spliced", "r1 0 chr1 191 255 10M100N10M * 0 0 " + seq + " *", false, []uint32{0, 3}, []int{20, 20}},
+		{"spliced junction", "r1 0 chr1 191 255 10M100N10M * 0 0 " + seq + " *", true, []uint32{0}, []int{20}},
+		{"spliced minus junction", "r1 16 chr1 591 255 10M100N10M * 0 0 " + seq + " *", true, []uint32{1}, []int{20}},
+		// Junction matching no intron of A, C or D
+		{"spliced other junction", "r1 0 chr1 191 255 10M50N10M * 0 0 " + seq + " *", false, []uint32{0, 2, 3}, []int{10, 10, 20}},
+		{"spliced other junction compatible", "r1 0 chr1 191 255 10M50N10M * 0 0 " + seq + " *", true, nil, nil},
+		{"unspliced junction", "r1 0 chr1 181 255 20M * 0 0 " + seq + " *", true, []uint32{0, 3}, []int{20, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			featuresOverlap := OverlapFeatureRead(testRecords(t, tt.read), 0, trees, tt.junction)
+			var ids []uint32
+			for featID := range featuresOverlap {
+				ids = append(ids, featID)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			var lengths []int
+			for _, featID := range ids {
+				lengths = append(lengths, featuresOverlap[featID].Length)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || !reflect.DeepEqual(lengths, tt.wantLength) {
+				t.Errorf("got %v %v, want %v %v", ids, lengths, tt.wantIDs, tt.wantLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+const (
+	MetageneLandmarkStart = iota
+	MetageneLandmarkEnd
+	MetageneLandmarkCDSStart
+	MetageneLandmarkCDSEnd
+)
+
+var MetageneLandmarkNames = []string{"start", "end", "cds_start", "cds_end"}
+
+// Metagene is the aggregated profile around a landmark, from -window to +window
+type Metagene struct {
+	Landmark int
+	NFeature int
+	Values   []float64
+}
+
+// landmarkPos returns the landmark position within the feature profile
+func landmarkPos(feat *feature.FeatureExt, landmark int, profileOverhang int) (int, bool) {
+	switch landmark {
+	case MetageneLandmarkStart:
+		return profileOverhang, true
+	case MetageneLandmarkEnd:
+		return len(feat.Profile) - 1 - profileOverhang, true
+	case MetageneLandmarkCDSStart:
+		if feat.ProfileCDS != nil {
+			return feat.ProfileCDS[0], true
+		}
+	case MetageneLandmarkCDSEnd:
+		if feat.ProfileCDS != nil {
+			return feat.ProfileCDS[1] - 1, true
+		}
+	}
+	return 0, false
+}
+
+// ComputeMetagenes aggregates (sum or mean if doMean) the profiles of features around each landmark. With featureNorm, each profile is divided by its mean before aggregation (features without reads are skipped). The mean at each position is computed over features with profile covering the position.
+func ComputeMetagenes(featureExts []*feature.FeatureExt, landmarks []int, window int, profileOverhang int, featureNorm bool, doMean bool) []Metagene {
+	metagenes := make([]Metagene, len(landmarks))
+	for il, landmark := range landmarks {
+		m := Metagene{Landmark: landmark, Values: make([]float64, 2*window+1)}
+		nCovered := make([]int, 2*window+1)
+		for _, feat := range featureExts {
+			pos, ok := landmarkPos(feat, landmark, profileOverhang)
+			if !ok || len(feat.Profile) == 0 {
+				continue
+			}
+			// Normalization factor
+			factor := 1.
+			if featureNorm {
+				var sum float64
+				for _, v := range feat.Profile {
+					sum += float64(v)
+				}
+				if sum == 0. {
+					continue
+				}
+				factor = float64(len(feat.Profile)) / sum
+			}
+			for i := 0; i <= 2*window; i++ {
+				p := pos - window + i
+				if p >= 0 && p < len(feat.Profile) {
+					m.Values[i] += float64(feat.Profile[p]) * factor
+					nCovered[i]++
+				}
+			}
+			m.NFeature++
+		}
+		if doMean {
+			for i := range m.Values {
+				if nCovered[i] > 0 {
+					m.Values[i] /= float64(nCovered[i])
+				}
+			}
+		}
+		metagenes[il] = m
+	}
+	return metagenes
+}
+
+// WriteMetagenes writes the metagenes in CSV (one row per landmark).
+func WriteMetagenes(mpath string, metagenes []Metagene, window int) error {
+	f, err := os.Create(mpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Header
+	f.WriteString("\"landmark\",\"n_feature\"")
+	for p := -window; p <= window; p++ {
+		fmt.Fprintf(f, ",\"%d\"", p)
+	}
+	f.WriteString("\n")
+	// Values
+	for _, m := range metagenes {
+		fmt.Fprintf(f, "\"%s\",%d", MetageneLandmarkNames[m.Landmark], m.NFeature)
+		for _, v := range m.Values {
+			f.WriteString(",")
+			f.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		f.WriteString("\n")
+	}
+	return nil
+}
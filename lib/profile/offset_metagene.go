@@ -0,0 +1,160 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// OffsetMetagene accumulates, per read length, read 5' end positions relative to the CDS start (from -Window to +Window)
+type OffsetMetagene struct {
+	Window int
+	Counts map[int][]float64
+}
+
+func NewOffsetMetagene(window int) *OffsetMetagene {
+	return &OffsetMetagene{Window: window, Counts: make(map[int][]float64)}
+}
+
+// Add adds the read 5' end position relative to the feature CDS start.
+func (m *OffsetMetagene) Add(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32) {
+	if feat.ProfileCDS == nil {
+		return
+	}
+	iRead := firstRead(areads, onlyRead1, paired, libraryR1Strand)
+	if iRead == -1 || !overlap.Read[iRead] {
+		return
+	}
+	// Get genomic position
+	var coord int
+	if feat.Strand == 1 {
+		coord = areads[iRead].Start()
+	} else {
+		coord = areads[iRead].End() - 1
+	}
+	// Transpose from genome to transcript coordinate
+	coordProfile, coordProfileInside := feat.CoordMapper.Genome2Transcript(coord)
+	if !coordProfileInside {
+		return
+	}
+	rel := coordProfile - feat.ProfileCDS[0]
+	if rel < -m.Window || rel > m.Window {
+		return
+	}
+	length := areads[iRead].Seq.Length
+	counts, ok := m.Counts[length]
+	if !ok {
+		counts = make([]float64, 2*m.Window+1)
+		m.Counts[length] = counts
+	}
+	counts[rel+m.Window] += float64(pairCount)
+}
+
+// Merge adds the counts of o and resets o.
+func (m *OffsetMetagene) Merge(o *OffsetMetagene) {
+	for length, ocounts := range o.Counts {
+		counts, ok := m.Counts[length]
+		if !ok {
+			counts = make([]float64, len(ocounts))
+			m.Counts[length] = counts
+		}
+		for i, c := range ocounts {
+			counts[i] += c
+			ocounts[i] = 0.
+		}
+	}
+}
+
+// Lengths returns the sorted read lengths.
+func (m *OffsetMetagene) Lengths() []int {
+	lengths := make([]int, 0, len(m.Counts))
+	for length := range m.Counts {
+		lengths = append(lengths, length)
+	}
+	sort.Ints(lengths)
+	return lengths
+}
+
+// Estimate returns the offset per read length: the distance from the read 5' end to the CDS start for the most frequent 5' end position upstream of the CDS start.
+func (m *OffsetMetagene) Estimate() map[int]int {
+	offsets := make(map[int]int)
+	for length, counts := range m.Counts {
+		var best float64
+		for offset := 0; offset <= m.Window && offset < length; offset++ {
+			if c := counts[m.Window-offset]; c > best {
+				best = c
+				offsets[length] = offset
+			}
+		}
+	}
+	return offsets
+}
+
+// Write writes the metagene in CSV (one row per read length) or in JSON if mpath extension is .json.
+func (m *OffsetMetagene) Write(mpath string) error {
+	f, err := os.Create(mpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if filepath.Ext(mpath) == ".json" {
+		positions := make([]int, 2*m.Window+1)
+		for i := range positions {
+			positions[i] = i - m.Window
+		}
+		counts := make(map[string][]float64)
+		for length, c := range m.Counts {
+			counts[strconv.Itoa(length)] = c
+		}
+		return json.NewEncoder(f).Encode(map[string]interface{}{"positions": positions, "counts": counts})
+	}
+	// Header
+	f.WriteString("\"read_length\"")
+	for p := -m.Window; p <= m.Window; p++ {
+		fmt.Fprintf(f, ",\"%d\"", p)
+	}
+	f.WriteString("\n")
+	// Counts
+	for _, length := range m.Lengths() {
+		f.WriteString(strconv.Itoa(length))
+		for _, c := range m.Counts[length] {
+			f.WriteString(",")
+			f.WriteString(strconv.FormatFloat(c, 'f', -1, 64))
+		}
+		f.WriteString("\n")
+	}
+	return nil
+}
+
+// WriteOffsets writes offsets per read length in the format read by OpenOffsets.
+func WriteOffsets(opath string, offsets map[int]int) error {
+	f, err := os.Create(opath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lengths := make([]int, 0, len(offsets))
+	for length := range offsets {
+		lengths = append(lengths, length)
+	}
+	sort.Ints(lengths)
+	for _, length := range lengths {
+		fmt.Fprintf(f, "%d\t%d\t5\n", length, offsets[length])
+	}
+	return nil
+}
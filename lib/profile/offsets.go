@@ -0,0 +1,73 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Offsets are read position offsets (P-site offsets for example) per read length, from the read 5' end (Five) or 3' end (Three)
+type Offsets struct {
+	Five  map[int]int
+	Three map[int]int
+}
+
+// OpenOffsets parses a tabulated file with read length, offset and optionally anchor (5 or 3) columns. Offsets without anchor are used from both read ends.
+func OpenOffsets(opath string) (*Offsets, error) {
+	o := Offsets{Five: make(map[int]int), Three: make(map[int]int)}
+
+	ofos, err := os.Open(opath)
+	if err != nil {
+		return nil, err
+	}
+	defer ofos.Close()
+
+	oscanner := bufio.NewScanner(ofos)
+	for oscanner.Scan() {
+		line := oscanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Wrong number of fields in %s: %s", opath, line)
+		}
+		length, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		anchor := ""
+		if len(fields) > 2 {
+			anchor = strings.TrimSuffix(fields[2], "'")
+		}
+		switch anchor {
+		case "5":
+			o.Five[length] = offset
+		case "3":
+			o.Three[length] = offset
+		case "":
+			o.Five[length] = offset
+			o.Three[length] = offset
+		default:
+			return nil, fmt.Errorf("Unknown anchor %s in %s (5 or 3 expected)", fields[2], opath)
+		}
+	}
+	if err := oscanner.Err(); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
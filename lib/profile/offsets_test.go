@@ -0,0 +1,58 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpenOffsets(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		content   string
+		wantFive  map[int]int
+		wantThree map[int]int
+		wantErr   bool
+	}{
+		{"header", "# length\toffset\tanchor\n\n28\t12\n", map[int]int{28: 12}, map[int]int{28: 12}, false},
+		{"anchors", "28\t12\t5\n29\t13\t5'\n30\t15\t3'\n31\t-2\t3\n", map[int]int{28: 12, 29: 13}, map[int]int{30: 15, 31: -2}, false},
+		{"missing offset", "28\n", nil, nil, true},
+		{"wrong length", "x\t12\n", nil, nil, true},
+		{"wrong offset", "28\t12.5\n", nil, nil, true},
+		{"wrong anchor", "28\t12\t4\n", nil, nil, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "offsets"+string(rune('a'+i))+".tab")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			o, err := OpenOffsets(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(o.Five, tt.wantFive) || !reflect.DeepEqual(o.Three, tt.wantThree) {
+				t.Errorf("got %v %v, want %v %v", o.Five, o.Three, tt.wantFive, tt.wantThree)
+			}
+		})
+	}
+	if _, err := OpenOffsets(filepath.Join(dir, "missing.tab")); err == nil {
+		t.Error("missing file: got no error")
+	}
+}
@@ -23,8 +23,22 @@ const (
 	ProfileTypeAll
 	ProfileTypeSplice
 	ProfileTypeExtension
+	ProfileTypeFrame
+	ProfileTypeMismatch
+	ProfileTypeRTStop
+	ProfileTypeBase
+	ProfileTypeInsertion
+	ProfileTypeDeletion
 )
 
+// ProfileChannelNames are the names of the channels of profile types with several values per position. Channel c of a profile of length L is stored from c*L to (c+1)*L.
+var ProfileChannelNames = map[int][]string{
+	ProfileTypeMismatch:  {"mismatch", "deletion", "coverage"},
+	ProfileTypeBase:      {"A", "C", "G", "T"},
+	ProfileTypeInsertion: {"site", "length"},
+	ProfileTypeDeletion:  {"span", "site", "length"},
+}
+
 // TrimUntemplated returns the number of untemplated nucleotide (max of maxShift).
 func TrimUntemplated(r *sam.Record, maxShift int, strand int8) (int, error) {
 	var iSymbol, iMatch, iMismatch, lenTU int
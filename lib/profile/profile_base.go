@@ -0,0 +1,63 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// baseChannels are the channels of bases on the plus and minus strand of the feature
+var baseChannels = [2]map[byte]int{
+	{'A': 0, 'C': 1, 'G': 2, 'T': 3},
+	{'T': 0, 'G': 1, 'C': 2, 'A': 3},
+}
+
+// ProfileBase adds the bases of aligned read(s) to the A, C, G and T channels of the profile. Bases are complemented on the minus strand to be sense to the feature. Unknown bases, insertions and soft-clipped bases are not included.
+func ProfileBase(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool) (bool, error) {
+	var coordProfile int
+	var coordProfileInside, added bool
+	length := len(feat.Profile) / len(ProfileChannelNames[ProfileTypeBase])
+	channels := baseChannels[0]
+	if feat.Strand == -1 {
+		channels = baseChannels[1]
+	}
+	for i := 0; i < len(areads); i++ {
+		if !overlap.Read[i] {
+			continue
+		}
+		_, read, _, err := esam.GetAln(areads[i])
+		if err != nil {
+			return added, err
+		}
+		for col, pos := range esam.AlnRefPos(areads[i]) {
+			if pos == -1 {
+				continue
+			}
+			channel, ok := channels[read[col]]
+			if !ok {
+				continue
+			}
+			// Transpose from genome to transcript coordinate
+			if profileNoCoordMapping {
+				coordProfile, coordProfileInside = pos, pos >= 0 && pos < length
+			} else {
+				coordProfile, coordProfileInside = feat.CoordMapper.Genome2Transcript(pos)
+			}
+			// Add count
+			if coordProfileInside {
+				profileChanges.Write(channel*length+coordProfile, pairCount)
+				added = true
+			}
+		}
+	}
+	return added, nil
+}
@@ -15,22 +15,11 @@ import (
 	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
 )
 
-func ProfileFirst(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool, profileUntemplated int, profileNoUntemplated bool) (bool, error) {
-	var coordProfile, iRead int
+func ProfileFirst(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool, profileUntemplated int, profileNoUntemplated bool, profileOffsets map[int]int) (bool, error) {
+	var coordProfile int
 	var coordProfileInside bool
 	// Determine which read is first in case of paired-end sequencing
-	if paired {
-		iRead = -1
-		if libraryR1Strand == 1 && (onlyRead1 || len(areads) == 2) {
-			iRead = 0
-		} else if libraryR1Strand == -1 {
-			if len(areads) == 2 {
-				iRead = 1
-			} else if len(areads) == 1 && !onlyRead1 {
-				iRead = 0
-			}
-		}
-	}
+	iRead := firstRead(areads, onlyRead1, paired, libraryR1Strand)
 	// Compute where to add the read
 	if iRead != -1 {
 		// Check that overlap is for this read
@@ -44,6 +33,8 @@ func ProfileFirst(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1St
 			coordProfile = areads[iRead].End() - 1
 		}
 		// Untemplated nucleotide
+		var shift int
+		coordProfileInside = true
 		if profileUntemplated > 0 {
 			lenTU, err := TrimUntemplated(areads[iRead], profileUntemplated, feat.Strand)
 			if err != nil {
@@ -63,16 +54,23 @@ func ProfileFirst(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1St
 				if profileNoUntemplated {
 					coordProfileInside = false
 				} else {
-					coordProfile, coordProfileInside = esam.ShiftPos(coordProfile, lenTU, areads[iRead], feat.Strand)
+					shift = lenTU
 				}
+			}
+		}
+		// Offset from read 5' end (P-site for example)
+		if profileOffsets != nil {
+			if offset, ok := profileOffsets[areads[iRead].Seq.Length]; ok {
+				shift += offset
 			} else {
-				coordProfileInside = true
+				coordProfileInside = false
 			}
+		}
+		if coordProfileInside && shift != 0 {
+			coordProfile, coordProfileInside = esam.ShiftPos(coordProfile, shift, areads[iRead], feat.Strand)
 			//if Debug {
 			//	fmt.Println("Trimming untemplated, New coordinate:", coordProfile, "\n")
 			//}
-		} else {
-			coordProfileInside = true
 		}
 		if coordProfileInside && !profileNoCoordMapping {
 			// Transpose from genome to transcript coordinate
@@ -85,3 +83,20 @@ func ProfileFirst(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1St
 	}
 	return coordProfileInside, nil
 }
+
+// firstRead returns the index of the read sequenced first (i.e. the fragment 5' end) or -1 if this read is not mapped
+func firstRead(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8) (iRead int) {
+	if paired {
+		iRead = -1
+		if libraryR1Strand == 1 && (onlyRead1 || len(areads) == 2) {
+			iRead = 0
+		} else if libraryR1Strand == -1 {
+			if len(areads) == 2 {
+				iRead = 1
+			} else if len(areads) == 1 && !onlyRead1 {
+				iRead = 0
+			}
+		}
+	}
+	return
+}
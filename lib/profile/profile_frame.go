@@ -0,0 +1,79 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// FrameCounts are counts per reading frame (0, 1 and 2) of CDS
+type FrameCounts [3]float64
+
+// ProfileFrame adds the read to the profile as ProfileFirst. It returns the reading frame of the read position within the feature CDS (-1 if outside CDS) and the read length.
+func ProfileFrame(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool, profileUntemplated int, profileNoUntemplated bool, profileOffsets map[int]int) (bool, int, int, error) {
+	frame := -1
+	coordProfileInside, err := ProfileFirst(areads, onlyRead1, paired, libraryR1Strand, overlap, feat, pairCount, profileChanges, profileNoCoordMapping, profileUntemplated, profileNoUntemplated, profileOffsets)
+	if err != nil || !coordProfileInside {
+		return coordProfileInside, frame, 0, err
+	}
+	// Position added by ProfileFirst
+	coordProfile := profileChanges.ProfileIdxs[profileChanges.ProfileLastIdx]
+	if feat.ProfileCDS != nil && coordProfile >= feat.ProfileCDS[0] && coordProfile < feat.ProfileCDS[1] {
+		frame = (coordProfile - feat.ProfileCDS[0]) % 3
+	}
+	return coordProfileInside, frame, areads[firstRead(areads, onlyRead1, paired, libraryR1Strand)].Seq.Length, nil
+}
+
+// WriteFrameCounts writes the frame counts and fractions of each key (feature or read length) in CSV, preceded by the total.
+func WriteFrameCounts(fpath string, keyName string, keys []string, counts []FrameCounts) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Header
+	fmt.Fprintf(f, "\"%s\",\"frame_0\",\"frame_1\",\"frame_2\",\"fraction_0\",\"fraction_1\",\"fraction_2\"\n", keyName)
+	// Total
+	var total FrameCounts
+	for _, c := range counts {
+		for i := 0; i < 3; i++ {
+			total[i] += c[i]
+		}
+	}
+	writeFrameRow(f, "total", total)
+	// Counts
+	for i, key := range keys {
+		writeFrameRow(f, key, counts[i])
+	}
+	return nil
+}
+
+func writeFrameRow(f *os.File, key string, c FrameCounts) {
+	sum := c[0] + c[1] + c[2]
+	fmt.Fprintf(f, "\"%s\"", key)
+	for i := 0; i < 3; i++ {
+		f.WriteString(",")
+		f.WriteString(strconv.FormatFloat(c[i], 'f', -1, 64))
+	}
+	for i := 0; i < 3; i++ {
+		f.WriteString(",")
+		if sum > 0. {
+			f.WriteString(strconv.FormatFloat(c[i]/sum, 'f', 4, 64))
+		} else {
+			f.WriteString("0")
+		}
+	}
+	f.WriteString("\n")
+}
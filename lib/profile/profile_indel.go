@@ -0,0 +1,100 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+const (
+	insertionChannelSite = iota
+	insertionChannelLength
+)
+
+const (
+	deletionChannelSpan = iota
+	deletionChannelSite
+	deletionChannelLength
+)
+
+// indelCoord transposes genomic position pos to the profile of length length.
+func indelCoord(feat *feature.FeatureExt, pos int, length int, profileNoCoordMapping bool) (int, bool) {
+	if profileNoCoordMapping {
+		return pos, pos >= 0 && pos < length
+	}
+	return feat.CoordMapper.Genome2Transcript(pos)
+}
+
+// ProfileInsertion adds insertions of aligned read(s) to the site and length (sum of inserted nucleotides) channels of the profile. Insertions are assigned to the reference position preceding them along the feature.
+func ProfileInsertion(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool) bool {
+	var added bool
+	length := len(feat.Profile) / len(ProfileChannelNames[ProfileTypeInsertion])
+	for ir := 0; ir < len(areads); ir++ {
+		if !overlap.Read[ir] {
+			continue
+		}
+		iRef := areads[ir].Start()
+		for _, co := range areads[ir].Cigar {
+			if co.Type() == sam.CigarInsertion {
+				// Preceding position along the feature
+				pos := iRef - 1
+				if feat.Strand == -1 {
+					pos = iRef
+				}
+				if coordProfile, inside := indelCoord(feat, pos, length, profileNoCoordMapping); inside {
+					profileChanges.Write(insertionChannelSite*length+coordProfile, pairCount)
+					profileChanges.Write(insertionChannelLength*length+coordProfile, pairCount*float32(co.Len()))
+					added = true
+				}
+			}
+			if co.Type().Consumes().Reference == 1 {
+				iRef += co.Len()
+			}
+		}
+	}
+	return added
+}
+
+// ProfileDeletion adds deletions of aligned read(s) to the span (all deleted positions), site (first deleted position along the feature) and length (sum of deleted nucleotides, at site) channels of the profile.
+func ProfileDeletion(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool) bool {
+	var added bool
+	length := len(feat.Profile) / len(ProfileChannelNames[ProfileTypeDeletion])
+	for ir := 0; ir < len(areads); ir++ {
+		if !overlap.Read[ir] {
+			continue
+		}
+		iRef := areads[ir].Start()
+		for _, co := range areads[ir].Cigar {
+			if co.Type() == sam.CigarDeletion {
+				// Span
+				for pos := iRef; pos < iRef+co.Len(); pos++ {
+					if coordProfile, inside := indelCoord(feat, pos, length, profileNoCoordMapping); inside {
+						profileChanges.Write(deletionChannelSpan*length+coordProfile, pairCount)
+						added = true
+					}
+				}
+				// First position along the feature
+				pos := iRef
+				if feat.Strand == -1 {
+					pos = iRef + co.Len() - 1
+				}
+				if coordProfile, inside := indelCoord(feat, pos, length, profileNoCoordMapping); inside {
+					profileChanges.Write(deletionChannelSite*length+coordProfile, pairCount)
+					profileChanges.Write(deletionChannelLength*length+coordProfile, pairCount*float32(co.Len()))
+				}
+			}
+			if co.Type().Consumes().Reference == 1 {
+				iRef += co.Len()
+			}
+		}
+	}
+	return added
+}
@@ -11,10 +11,11 @@ package profile
 import (
 	"github.com/biogo/hts/sam"
 
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
 	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
 )
 
-func ProfileLast(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool) bool {
+func ProfileLast(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool, profileOffsets map[int]int) bool {
 	var coordProfile, iRead int
 	var coordProfileInside bool
 	// Determine which read is last in case of paired-end sequencing
@@ -42,10 +43,17 @@ func ProfileLast(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Str
 		} else {
 			coordProfile = areads[iRead].Start()
 		}
+		coordProfileInside = true
+		// Offset from read 3' end
+		if profileOffsets != nil {
+			if offset, ok := profileOffsets[areads[iRead].Seq.Length]; !ok {
+				coordProfileInside = false
+			} else if offset != 0 {
+				coordProfile, coordProfileInside = esam.ShiftPos(coordProfile, offset, areads[iRead], -feat.Strand)
+			}
+		}
 		// Transpose from genome to transcript coordinate
-		if profileNoCoordMapping {
-			coordProfileInside = true
-		} else {
+		if coordProfileInside && !profileNoCoordMapping {
 			coordProfile, coordProfileInside = feat.CoordMapper.Genome2Transcript(coordProfile)
 		}
 		// Add count
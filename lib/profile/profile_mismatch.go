@@ -0,0 +1,82 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"fmt"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/esam"
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+const (
+	mismatchChannelMismatch = iota
+	mismatchChannelDeletion
+	mismatchChannelCoverage
+)
+
+// ProfileMismatch adds mismatches (from MD tag), deletions and coverage of aligned read(s) to the mismatch, deletion and coverage channels of the profile.
+func ProfileMismatch(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool) (bool, error) {
+	var coordProfile int
+	var coordProfileInside, added bool
+	length := len(feat.Profile) / len(ProfileChannelNames[ProfileTypeMismatch])
+	for i := 0; i < len(areads); i++ {
+		if !overlap.Read[i] {
+			continue
+		}
+		if _, found := areads[i].Tag([]byte("MD")); !found {
+			return added, fmt.Errorf("Missing MD tag")
+		}
+		_, read, symbol, err := esam.GetAln(areads[i])
+		if err != nil {
+			return added, err
+		}
+		for col, pos := range esam.AlnRefPos(areads[i]) {
+			if pos == -1 {
+				continue
+			}
+			// Transpose from genome to transcript coordinate
+			if profileNoCoordMapping {
+				coordProfile, coordProfileInside = pos, pos >= 0 && pos < length
+			} else {
+				coordProfile, coordProfileInside = feat.CoordMapper.Genome2Transcript(pos)
+			}
+			if !coordProfileInside {
+				continue
+			}
+			// Add count
+			if read[col] == '-' {
+				profileChanges.Write(mismatchChannelDeletion*length+coordProfile, pairCount)
+			} else if symbol[col] == 'X' {
+				profileChanges.Write(mismatchChannelMismatch*length+coordProfile, pairCount)
+			}
+			profileChanges.Write(mismatchChannelCoverage*length+coordProfile, pairCount)
+			added = true
+		}
+	}
+	return added, nil
+}
+
+// MismatchRate returns features with profiles of mutation rate, i.e. (mismatch + deletion) / coverage, from the mismatch, deletion and coverage channels.
+func MismatchRate(channelExts [][]*feature.FeatureExt) []*feature.FeatureExt {
+	rateExts := make([]*feature.FeatureExt, len(channelExts[mismatchChannelCoverage]))
+	for i, cov := range channelExts[mismatchChannelCoverage] {
+		rate := *cov
+		rate.Profile = make([]float32, len(cov.Profile))
+		for p, c := range cov.Profile {
+			if c != 0. {
+				rate.Profile[p] = (channelExts[mismatchChannelMismatch][i].Profile[p] + channelExts[mismatchChannelDeletion][i].Profile[p]) / c
+			}
+		}
+		rateExts[i] = &rate
+	}
+	return rateExts
+}
@@ -0,0 +1,47 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// ProfileRTStop adds the reverse-transcription stop (crosslink site for CLIP or modified nucleotide for icSHAPE), i.e. the read 5' end as in ProfileFirst shifted by profileRTShift nucleotides (negative upstream) along the feature.
+func ProfileRTStop(areads []*sam.Record, onlyRead1 bool, paired bool, libraryR1Strand int8, overlap feature.FeatureOverlap, feat *feature.FeatureExt, pairCount float32, profileChanges *ProfileChange, profileNoCoordMapping bool, profileRTShift int) bool {
+	var coordProfile int
+	var coordProfileInside bool
+	// Determine which read is first in case of paired-end sequencing
+	iRead := firstRead(areads, onlyRead1, paired, libraryR1Strand)
+	if iRead == -1 || !overlap.Read[iRead] {
+		return false
+	}
+	// Get genomic position
+	if feat.Strand == 1 {
+		coordProfile = areads[iRead].Start()
+	} else {
+		coordProfile = areads[iRead].End() - 1
+	}
+	if profileNoCoordMapping {
+		// Shift along the genome
+		coordProfile += profileRTShift * int(feat.Strand)
+		coordProfileInside = coordProfile >= 0 && coordProfile < len(feat.Profile)
+	} else {
+		// Transpose from genome to transcript coordinate and shift along the transcript (across splice junctions)
+		coordProfile, coordProfileInside = feat.CoordMapper.Genome2Transcript(coordProfile)
+		coordProfile += profileRTShift
+		coordProfileInside = coordProfileInside && coordProfile >= 0 && coordProfile < len(feat.Profile)
+	}
+	// Add count
+	if coordProfileInside {
+		profileChanges.Write(coordProfile, pairCount)
+	}
+	return coordProfileInside
+}
@@ -0,0 +1,399 @@
+//
+// Copyright © 2015 Charles E. Vejnar
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://www.mozilla.org/MPL/2.0/.
+//
+
+package profile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/sam"
+
+	"git.sr.ht/~vejnar/GeneAbacus/lib/feature"
+)
+
+// testRead returns the single-end read of a SAM line on chr1.
+func testRead(t *testing.T, line string) []*sam.Record {
+	t.Helper()
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r sam.Record
+	if err := r.UnmarshalSAM(header, []byte(strings.Join(strings.Fields(line), "\t"))); err != nil {
+		t.Fatal(err)
+	}
+	return []*sam.Record{&r}
+}
+
+// testFeature returns a feature on chr1 with a profile of nChannel channels.
+func testFeature(t *testing.T, strand int8, coords [][]int, cds []int, nChannel int) *feature.FeatureExt {
+	t.Helper()
+	featureExts, err := feature.ExtendFeatures([]feature.Feature{{Name: "f1", Chrom: "chr1", Strand: strand, Coords: coords, CDS: cds}}, []int{1}, nil, true, true, 0, nChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return featureExts[0]
+}
+
+// changedPositions returns the values written to the profile per position.
+func changedPositions(c *ProfileChange) map[int]float32 {
+	changes := make(map[int]float32)
+	for i := 0; i <= c.ProfileLastIdx; i++ {
+		changes[c.ProfileIdxs[i]] += c.ProfileCounts[i]
+	}
+	return changes
+}
+
+// overlapAll is the overlap of one read with a feature.
+var overlapAll = feature.FeatureOverlap{Length: 1, Read: []bool{true}}
+
+func TestTrimUntemplated(t *testing.T) {
+	seq := strings.Repeat("A", 20)
+	tests := []struct {
+		name   string
+		strand int8
+		read   string
+		want   int
+	}{
+		// M operations (same result as before = and X support)
+		{"templated", 1, "r1 0 chr1 101 255 20M * 0 0 " + seq + " * MD:Z:20", 0},
+		{"mismatches", 1, "r1 0 chr1 101 255 20M * 0 0 " + seq + " * MD:Z:0T0T18", 2},
+		{"mismatch after maxShift", 1, "r1 0 chr1 101 255 20M * 0 0 " + seq + " * MD:Z:3T16", 0},
+		{"soft clip", 1, "r1 0 chr1 101 255 2S18M * 0 0 " + seq + " * MD:Z:18", 2},
+		// = operations are matches
+		{"equal", 1, "r1 0 chr1 101 255 20= * 0 0 " + seq + " *", 0},
+		{"equal and mismatch", 1, "r1 0 chr1 101 255 1X19= * 0 0 " + seq + " *", 1},
+		{"minus mismatches", -1, "r1 16 chr1 101 255 20M * 0 0 " + seq + " * MD:Z:18T0T0", 2},
+		// Mismatches following intron
+		{"minus intron", -1, "r1 16 chr1 101 255 18M10N2M * 0 0 " + seq + " * MD:Z:18T0T0", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TrimUntemplated(testRead(t, tt.read)[0], 3, tt.strand)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetMetageneEstimate(t *testing.T) {
+	m := NewOffsetMetagene(15)
+	m.Counts[28] = make([]float64, 31)
+	// Peak 12 nt upstream of CDS start. Downstream positions are ignored.
+	m.Counts[28][15-12] = 10
+	m.Counts[28][15-13] = 5
+	m.Counts[28][15+2] = 50
+	// Offset must be shorter than read length
+	m.Counts[10] = make([]float64, 31)
+	m.Counts[10][15-12] = 10
+	m.Counts[10][15-3] = 1
+	// No count upstream
+	m.Counts[30] = make([]float64, 31)
+	m.Counts[30][15+1] = 1
+	if got, want := m.Estimate(), map[int]int{28: 12, 10: 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProfileFrame(t *testing.T) {
+	seq := strings.Repeat("A", 20)
+	tests := []struct {
+		name        string
+		strand      int8
+		read        string
+		wantInside  bool
+		wantFrame   int
+		wantProfile int
+	}{
+		{"plus frame 0", 1, "r1 0 chr1 111 255 20M * 0 0 " + seq + " *", true, 0, 10},
+		{"plus frame 1", 1, "r1 0 chr1 112 255 20M * 0 0 " + seq + " *", true, 1, 11},
+		{"plus frame 2", 1, "r1 0 chr1 116 255 20M * 0 0 " + seq + " *", true, 2, 15},
+		{"plus before CDS", 1, "r1 0 chr1 106 255 20M * 0 0 " + seq + " *", true, -1, 5},
+		// 5' end at 189: profile position 10, CDS start
+		{"minus frame 0", -1, "r1 16 chr1 171 255 20M * 0 0 " + seq + " *", true, 0, 10},
+		{"minus frame 2", -1, "r1 16 chr1 169 255 20M * 0 0 " + seq + " *", true, 2, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// CDS [110,200) on plus strand and [100,190) on minus strand: CDS starts at position 10 of profile
+			cds := []int{110, 200}
+			if tt.strand == -1 {
+				cds = []int{100, 190}
+			}
+			feat := testFeature(t, tt.strand, [][]int{{100, 200}}, cds, 1)
+			changes := NewProfileChange(1)
+			inside, frame, length, err := ProfileFrame(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false, 0, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inside != tt.wantInside || frame != tt.wantFrame || length != 20 {
+				t.Errorf("got %v %d %d, want %v %d 20", inside, frame, length, tt.wantInside, tt.wantFrame)
+			}
+			if got, want := changedPositions(changes), map[int]float32{tt.wantProfile: 1}; !reflect.DeepEqual(got, want) {
+				t.Errorf("profile: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestComputeMetagenes(t *testing.T) {
+	// Profiles of length 6 with CDS [2,4)
+	var featureExts []*feature.FeatureExt
+	for _, profile := range [][]float32{{0, 1, 2, 3, 4, 5}, {0, 0, 4, 0, 0, 2}} {
+		featureExts = append(featureExts, &feature.FeatureExt{ProfileCDS: []int{2, 4}, Profile: profile})
+	}
+	// Feature without CDS: only for start and end
+	featureExts = append(featureExts, &feature.FeatureExt{Profile: []float32{6, 0, 0, 0, 0, 0}})
+	tests := []struct {
+		name        string
+		featureNorm bool
+		doMean      bool
+		want        []Metagene
+	}{
+		{"sum", false, false, []Metagene{
+			{MetageneLandmarkStart, 3, []float64{0, 6, 1}},
+			{MetageneLandmarkCDSStart, 2, []float64{1, 6, 3}},
+			{MetageneLandmarkEnd, 3, []float64{4, 7, 0}},
+		}},
+		{"mean", false, true, []Metagene{
+			{MetageneLandmarkStart, 3, []float64{0, 2, 1. / 3.}},
+			{MetageneLandmarkCDSStart, 2, []float64{0.5, 3, 1.5}},
+			{MetageneLandmarkEnd, 3, []float64{4. / 3., 7. / 3., 0}},
+		}},
+		// Profiles divided by their mean (2.5, 1 and 1)
+		{"feature norm", true, false, []Metagene{
+			{MetageneLandmarkStart, 3, []float64{0, 6, 0.4}},
+			{MetageneLandmarkCDSStart, 2, []float64{0.4, 4.8, 1.2}},
+			{MetageneLandmarkEnd, 3, []float64{1.6, 4, 0}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ComputeMetagenes(featureExts, []int{MetageneLandmarkStart, MetageneLandmarkCDSStart, MetageneLandmarkEnd}, 1, 0, tt.featureNorm, tt.doMean)
+			for i, m := range got {
+				w := tt.want[i]
+				if m.Landmark != w.Landmark || m.NFeature != w.NFeature {
+					t.Errorf("%s: got %d features, want %d", MetageneLandmarkNames[w.Landmark], m.NFeature, w.NFeature)
+				}
+				for p := range w.Values {
+					if diff := m.Values[p] - w.Values[p]; diff > 1e-6 || diff < -1e-6 {
+						t.Errorf("%s: got %v, want %v", MetageneLandmarkNames[w.Landmark], m.Values, w.Values)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProfileMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		strand int8
+		read   string
+		// Positions with mismatch, deletion and coverage
+		want map[int]float32
+	}{
+		// Mismatch at 104
+		{"mismatch", 1, "r1 0 chr1 101 255 6M * 0 0 CCCCGC * MD:Z:4A1", map[int]float32{0 + 4: 1, 200 + 0: 1, 200 + 1: 1, 200 + 2: 1, 200 + 3: 1, 200 + 4: 1, 200 + 5: 1}},
+		// Deletion at 103
+		{"deletion", 1, "r1 0 chr1 101 255 3M1D2M * 0 0 CCCCC * MD:Z:3^A2", map[int]float32{100 + 3: 1, 200 + 0: 1, 200 + 1: 1, 200 + 2: 1, 200 + 3: 1, 200 + 4: 1, 200 + 5: 1}},
+		// Mismatch at 104 on minus strand: position 95
+		{"mismatch minus", -1, "r1 16 chr1 101 255 6M * 0 0 CCCCGC * MD:Z:4A1", map[int]float32{95: 1, 200 + 94: 1, 200 + 95: 1, 200 + 96: 1, 200 + 97: 1, 200 + 98: 1, 200 + 99: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feat := testFeature(t, tt.strand, [][]int{{100, 200}}, nil, len(ProfileChannelNames[ProfileTypeMismatch]))
+			changes := NewProfileChange(1)
+			added, err := ProfileMismatch(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := changedPositions(changes); !added || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", added, got, tt.want)
+			}
+		})
+	}
+	// Missing MD tag
+	feat := testFeature(t, 1, [][]int{{100, 200}}, nil, 3)
+	if _, err := ProfileMismatch(testRead(t, "r1 0 chr1 101 255 6M * 0 0 CCCCGC *"), false, false, 0, overlapAll, feat, 1., NewProfileChange(1), false); err == nil {
+		t.Error("got nil error without MD tag")
+	}
+}
+
+func TestMismatchRate(t *testing.T) {
+	profile := []float32{1, 0, 0, 0, 1, 0, 4, 2, 0}
+	channelExts := feature.SplitChannels([]*feature.FeatureExt{{Profile: profile}}, 3)
+	if got, want := MismatchRate(channelExts)[0].Profile, []float32{0.25, 0.5, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProfileRTStop(t *testing.T) {
+	// Exons [100,150) and [200,250): profile positions 0-49 and 50-99
+	coords := [][]int{{100, 150}, {200, 250}}
+	seq := strings.Repeat("A", 20)
+	tests := []struct {
+		name       string
+		strand     int8
+		read       string
+		shift      int
+		wantInside bool
+		wantPos    int
+	}{
+		{"no shift", 1, "r1 0 chr1 204 255 20M * 0 0 " + seq + " *", 0, true, 53},
+		{"upstream across junction", 1, "r1 0 chr1 204 255 20M * 0 0 " + seq + " *", -5, true, 48},
+		{"upstream outside", 1, "r1 0 chr1 102 255 20M * 0 0 " + seq + " *", -2, false, 0},
+		{"downstream", 1, "r1 0 chr1 102 255 20M * 0 0 " + seq + " *", 3, true, 4},
+		// 5' end at 138: profile position 61
+		{"minus upstream", -1, "r1 16 chr1 120 255 20M * 0 0 " + seq + " *", -1, true, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feat := testFeature(t, tt.strand, coords, nil, 1)
+			changes := NewProfileChange(1)
+			inside := ProfileRTStop(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false, tt.shift)
+			if inside != tt.wantInside {
+				t.Fatalf("got %v, want %v", inside, tt.wantInside)
+			}
+			if inside {
+				if got, want := changedPositions(changes), map[int]float32{tt.wantPos: 1}; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileOffsets(t *testing.T) {
+	// Exons [100,150) and [200,250): profile positions 0-49 and 50-99 (+ strand) or 99-50 and 49-0 (- strand)
+	coords := [][]int{{100, 150}, {200, 250}}
+	seq := strings.Repeat("A", 20)
+	tests := []struct {
+		name       string
+		last       bool
+		strand     int8
+		read       string
+		offsets    map[int]int
+		wantInside bool
+		wantPos    int
+	}{
+		// 5' end at 110
+		{"first", false, 1, "r1 0 chr1 111 255 20M * 0 0 " + seq + " *", map[int]int{20: 5}, true, 15},
+		// 5' end at 140, shifted across intron to 202
+		{"first intron", false, 1, "r1 0 chr1 141 255 10M50N10M * 0 0 " + seq + " *", map[int]int{20: 12}, true, 52},
+		{"first other length", false, 1, "r1 0 chr1 111 255 20M * 0 0 " + seq + " *", map[int]int{21: 5}, false, 0},
+		// 5' end at 229
+		{"first minus", false, -1, "r1 16 chr1 211 255 20M * 0 0 " + seq + " *", map[int]int{20: 5}, true, 25},
+		// 5' end at 209, shifted across intron to 147
+		{"first minus intron", false, -1, "r1 16 chr1 141 255 10M50N10M * 0 0 " + seq + " *", map[int]int{20: 12}, true, 52},
+		// 3' end at 149
+		{"last", true, 1, "r1 0 chr1 131 255 20M * 0 0 " + seq + " *", map[int]int{20: 5}, true, 44},
+		// 3' end at 209, shifted across intron to 147
+		{"last intron", true, 1, "r1 0 chr1 141 255 10M50N10M * 0 0 " + seq + " *", map[int]int{20: 12}, true, 47},
+		{"last other length", true, 1, "r1 0 chr1 131 255 20M * 0 0 " + seq + " *", map[int]int{21: 5}, false, 0},
+		// 3' end at 110
+		{"last minus", true, -1, "r1 16 chr1 111 255 20M * 0 0 " + seq + " *", map[int]int{20: 5}, true, 84},
+		// 3' end at 140, shifted across intron to 202
+		{"last minus intron", true, -1, "r1 16 chr1 141 255 10M50N10M * 0 0 " + seq + " *", map[int]int{20: 12}, true, 47},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feat := testFeature(t, tt.strand, coords, nil, 1)
+			changes := NewProfileChange(1)
+			var inside bool
+			if tt.last {
+				inside = ProfileLast(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false, tt.offsets)
+			} else {
+				var err error
+				if inside, err = ProfileFirst(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false, 0, false, tt.offsets); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if inside != tt.wantInside {
+				t.Fatalf("got %v, want %v", inside, tt.wantInside)
+			}
+			if inside {
+				if got, want := changedPositions(changes), map[int]float32{tt.wantPos: 1}; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileBase(t *testing.T) {
+	tests := []struct {
+		name   string
+		strand int8
+		read   string
+		want   map[int]float32
+	}{
+		// A, C, G and T channels: N, insertion and soft-clipped bases are skipped
+		{"plus", 1, "r1 0 chr1 101 255 1S3M1I2M * 0 0 TACGTNT *", map[int]float32{0*100 + 0: 1, 1*100 + 1: 1, 2*100 + 2: 1, 3*100 + 4: 1}},
+		// Complemented: A at 100 is T at position 99
+		{"minus", -1, "r1 16 chr1 101 255 2M * 0 0 AC *", map[int]float32{3*100 + 99: 1, 2*100 + 98: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feat := testFeature(t, tt.strand, [][]int{{100, 200}}, nil, len(ProfileChannelNames[ProfileTypeBase]))
+			changes := NewProfileChange(1)
+			added, err := ProfileBase(testRead(t, tt.read), false, false, 0, overlapAll, feat, 1., changes, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := changedPositions(changes); !added || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v", added, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileIndel(t *testing.T) {
+	tests := []struct {
+		name          string
+		strand        int8
+		read          string
+		wantInsertion map[int]float32
+		wantDeletion  map[int]float32
+	}{
+		// Insertion of 2 after 104. Deletion of 105-107.
+		{"plus", 1, "r1 0 chr1 101 255 5M2I5M3D5M * 0 0 " + strings.Repeat("A", 17) + " *",
+			map[int]float32{0*100 + 4: 1, 1*100 + 4: 2},
+			map[int]float32{0*100 + 10: 1, 0*100 + 11: 1, 0*100 + 12: 1, 1*100 + 10: 1, 2*100 + 10: 3}},
+		// Along minus strand, insertion before 105 (position 94) and deletion from 112 (position 87)
+		{"minus", -1, "r1 16 chr1 101 255 5M2I5M3D5M * 0 0 " + strings.Repeat("A", 17) + " *",
+			map[int]float32{0*100 + 94: 1, 1*100 + 94: 2},
+			map[int]float32{0*100 + 89: 1, 0*100 + 88: 1, 0*100 + 87: 1, 1*100 + 87: 1, 2*100 + 87: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			areads := testRead(t, tt.read)
+			feat := testFeature(t, tt.strand, [][]int{{100, 200}}, nil, len(ProfileChannelNames[ProfileTypeInsertion]))
+			changes := NewProfileChange(1)
+			if added := ProfileInsertion(areads, false, false, 0, overlapAll, feat, 1., changes, false); !added || !reflect.DeepEqual(changedPositions(changes), tt.wantInsertion) {
+				t.Errorf("insertion: got %v %v, want %v", added, changedPositions(changes), tt.wantInsertion)
+			}
+			feat = testFeature(t, tt.strand, [][]int{{100, 200}}, nil, len(ProfileChannelNames[ProfileTypeDeletion]))
+			changes = NewProfileChange(1)
+			if added := ProfileDeletion(areads, false, false, 0, overlapAll, feat, 1., changes, false); !added || !reflect.DeepEqual(changedPositions(changes), tt.wantDeletion) {
+				t.Errorf("deletion: got %v %v, want %v", added, changedPositions(changes), tt.wantDeletion)
+			}
+		})
+	}
+}